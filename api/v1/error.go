@@ -32,3 +32,32 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrOffsetBelowWatermark struct {
+	Offset    uint64
+	Watermark uint64
+}
+
+func (e ErrOffsetBelowWatermark) GRPCStatus() *status.Status {
+	st := status.New(
+		404,
+		fmt.Sprintf("offset below watermark: %d < %d", e.Offset, e.Watermark))
+	msg := fmt.Sprintf(
+		"The requested offset has been truncated from the log: %d, the lowest offset is %d",
+		e.Offset,
+		e.Watermark,
+		)
+	d := &errdetails.LocalizedMessage{
+		Locale: "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetBelowWatermark) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
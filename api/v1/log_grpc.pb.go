@@ -20,7 +20,10 @@ type LogClient interface {
 	Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
+	// ConsumeAcked streams records like ConsumeStream but resumes each consumer from the first record it didn't ack
+	ConsumeAcked(ctx context.Context, opts ...grpc.CallOption) (Log_ConsumeAckedClient, error)
 	ProduceStream(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
+	ConsumeBatch(ctx context.Context, in *ConsumeBatchRequest, opts ...grpc.CallOption) (*ConsumeBatchResponse, error)
 }
 
 type logClient struct {
@@ -81,8 +84,39 @@ func (x *logConsumeStreamClient) Recv() (*ConsumeResponse, error) {
 	return m, nil
 }
 
+func (c *logClient) ConsumeAcked(ctx context.Context, opts ...grpc.CallOption) (Log_ConsumeAckedClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Log_serviceDesc.Streams[1], "/log.v1.Log/ConsumeAcked", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logConsumeAckedClient{stream}
+	return x, nil
+}
+
+type Log_ConsumeAckedClient interface {
+	Send(*ConsumeAckRequest) error
+	Recv() (*ConsumeResponse, error)
+	grpc.ClientStream
+}
+
+type logConsumeAckedClient struct {
+	grpc.ClientStream
+}
+
+func (x *logConsumeAckedClient) Send(m *ConsumeAckRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *logConsumeAckedClient) Recv() (*ConsumeResponse, error) {
+	m := new(ConsumeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *logClient) ProduceStream(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (Log_ProduceStreamClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_Log_serviceDesc.Streams[1], "/log.v1.Log/ProduceStream", opts...)
+	stream, err := c.cc.NewStream(ctx, &_Log_serviceDesc.Streams[2], "/log.v1.Log/ProduceStream", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +147,15 @@ func (x *logProduceStreamClient) Recv() (*ProduceResponse, error) {
 	return m, nil
 }
 
+func (c *logClient) ConsumeBatch(ctx context.Context, in *ConsumeBatchRequest, opts ...grpc.CallOption) (*ConsumeBatchResponse, error) {
+	out := new(ConsumeBatchResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/ConsumeBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
@@ -120,7 +163,10 @@ type LogServer interface {
 	Produce(context.Context, *ProduceRequest) (*ProduceResponse, error)
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
 	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
+	// ConsumeAcked streams records like ConsumeStream but resumes each consumer from the first record it didn't ack
+	ConsumeAcked(Log_ConsumeAckedServer) error
 	ProduceStream(*ProduceRequest, Log_ProduceStreamServer) error
+	ConsumeBatch(context.Context, *ConsumeBatchRequest) (*ConsumeBatchResponse, error)
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -137,9 +183,15 @@ func (UnimplementedLogServer) Consume(context.Context, *ConsumeRequest) (*Consum
 func (UnimplementedLogServer) ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ConsumeStream not implemented")
 }
+func (UnimplementedLogServer) ConsumeAcked(Log_ConsumeAckedServer) error {
+	return status.Errorf(codes.Unimplemented, "method ConsumeAcked not implemented")
+}
 func (UnimplementedLogServer) ProduceStream(*ProduceRequest, Log_ProduceStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
 }
+func (UnimplementedLogServer) ConsumeBatch(context.Context, *ConsumeBatchRequest) (*ConsumeBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ConsumeBatch not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -210,6 +262,32 @@ func (x *logConsumeStreamServer) Send(m *ConsumeResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _Log_ConsumeAcked_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogServer).ConsumeAcked(&logConsumeAckedServer{stream})
+}
+
+type Log_ConsumeAckedServer interface {
+	Send(*ConsumeResponse) error
+	Recv() (*ConsumeAckRequest, error)
+	grpc.ServerStream
+}
+
+type logConsumeAckedServer struct {
+	grpc.ServerStream
+}
+
+func (x *logConsumeAckedServer) Send(m *ConsumeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *logConsumeAckedServer) Recv() (*ConsumeAckRequest, error) {
+	m := new(ConsumeAckRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _Log_ProduceStream_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(ProduceRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -231,6 +309,24 @@ func (x *logProduceStreamServer) Send(m *ProduceResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _Log_ConsumeBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConsumeBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).ConsumeBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/ConsumeBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).ConsumeBatch(ctx, req.(*ConsumeBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Log_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "log.v1.Log",
 	HandlerType: (*LogServer)(nil),
@@ -243,6 +339,10 @@ var _Log_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Consume",
 			Handler:    _Log_Consume_Handler,
 		},
+		{
+			MethodName: "ConsumeBatch",
+			Handler:    _Log_ConsumeBatch_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -250,6 +350,12 @@ var _Log_serviceDesc = grpc.ServiceDesc{
 			Handler:       _Log_ConsumeStream_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "ConsumeAcked",
+			Handler:       _Log_ConsumeAcked_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 		{
 			StreamName:    "ProduceStream",
 			Handler:       _Log_ProduceStream_Handler,
@@ -0,0 +1,180 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+var ErrAckNotSent = errors.New("log: ack for an offset not sent on the stream")
+
+/*
+AckTracker tracks which offsets consumers have acked on streams that require acks, for at-least-once delivery. A
+consumer's resume point is its first record sent but not acked, or past the last one sent once they're all acked, so
+reconnecting redelivers anything it didn't ack. With an OffsetStore the resume points are committed under the consumer
+names and survive restarts.
+*/
+type AckTracker struct {
+	mu      sync.Mutex
+	offsets *OffsetStore
+	streams map[string]*ackStream
+}
+
+type ackStream struct {
+	// pending holds the offsets sent and not yet acked, or acked out of order behind one that isn't, in send order
+	pending []uint64
+	acked   map[uint64]bool
+	resume  uint64
+}
+
+/*
+NewAckTracker returns a tracker committing resume points to offsets, which may be nil to keep them in memory only.
+*/
+func NewAckTracker(offsets *OffsetStore) *AckTracker {
+	return &AckTracker{offsets: offsets, streams: make(map[string]*ackStream)}
+}
+
+/*
+Resume starts a stream for the consumer, returning where it should read from: its resume point if it has one, else
+from. Offsets sent on its previous stream and never acked are forgotten, since they'll be sent again.
+*/
+func (a *AckTracker) Resume(consumer string, from uint64) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.streams[consumer]
+	if !ok {
+		s = &ackStream{resume: from}
+		if a.offsets != nil {
+			off, err := a.offsets.CommittedOffset(consumer)
+			switch err {
+			case nil:
+				s.resume = off
+			case ErrNoCommittedOffset:
+			default:
+				return 0, err
+			}
+		}
+		a.streams[consumer] = s
+	}
+	s.pending, s.acked = nil, make(map[uint64]bool)
+	return s.resume, nil
+}
+
+/*
+Sent records that the record at off was sent to the consumer and awaits its ack.
+*/
+func (a *AckTracker) Sent(consumer string, off uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.streams[consumer]
+	if !ok {
+		return
+	}
+	s.pending = append(s.pending, off)
+}
+
+/*
+Ack records the consumer's ack of the record at off, moving its resume point past every record acked in a row from the
+first pending one. It returns ErrAckNotSent for offsets the current stream didn't send.
+*/
+func (a *AckTracker) Ack(consumer string, off uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.streams[consumer]
+	if !ok || !s.isPending(off) {
+		return ErrAckNotSent
+	}
+	s.acked[off] = true
+	resume := s.resume
+	for len(s.pending) > 0 && s.acked[s.pending[0]] {
+		delete(s.acked, s.pending[0])
+		resume = s.pending[0] + 1
+		s.pending = s.pending[1:]
+	}
+	if resume == s.resume {
+		return nil
+	}
+	if a.offsets != nil {
+		if err := a.offsets.CommitOffset(consumer, resume); err != nil {
+			return err
+		}
+	}
+	s.resume = resume
+	return nil
+}
+
+/*
+Serve runs a ConsumeAcked stream: it resumes the consumer named by the stream's first message, sends what consume
+returns from there on, and takes acks for what's sent from the rest of the messages until the client closes its side
+or the stream's context is done.
+*/
+func (a *AckTracker) Serve(
+	stream api.Log_ConsumeAckedServer,
+	consume func(context.Context, *api.ConsumeRequest) (*api.ConsumeResponse, error),
+) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	req := first.Start
+	if req == nil {
+		req = &api.ConsumeRequest{}
+	}
+	if req.Offset, err = a.Resume(first.Consumer, req.Offset); err != nil {
+		return err
+	}
+	acked := make(chan error, 1)
+	go func() {
+		for {
+			ack, err := stream.Recv()
+			if err == nil {
+				err = a.Ack(first.Consumer, ack.Ack)
+			}
+			if err != nil {
+				acked <- err
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-acked:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		default:
+			res, err := consume(stream.Context(), req)
+			switch err.(type) {
+			case nil:
+			case api.ErrOffsetOutOfRange:
+				continue
+			default:
+				return err
+			}
+			off := res.Offset
+			if res.Record != nil {
+				off = res.Record.Offset
+			}
+			a.Sent(first.Consumer, off)
+			if err = stream.Send(res); err != nil {
+				return err
+			}
+			req.Offset = off + 1
+		}
+	}
+}
+
+func (s *ackStream) isPending(off uint64) bool {
+	for _, p := range s.pending {
+		if p == off {
+			return !s.acked[off]
+		}
+	}
+	return false
+}
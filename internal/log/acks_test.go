@@ -0,0 +1,170 @@
+package log
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+/*
+TestAckTrackerRedelivery streams records to a consumer the way the server does, disconnecting before the consumer acks
+the last one sent, and checks the next stream redelivers it, including after a restart.
+*/
+func TestAckTrackerRedelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ack-tracker-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := NewMemLog(Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 4; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	offsets, err := NewOffsetStore(path.Join(dir, "offsets"))
+	require.NoError(t, err)
+
+	// stream sends n records from where the consumer resumes, acking the ones in acks, and returns what it sent
+	stream := func(a *AckTracker, n int, acks ...uint64) []uint64 {
+		off, err := a.Resume("billing", 0)
+		require.NoError(t, err)
+		var sent []uint64
+		for ; len(sent) < n; off++ {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			a.Sent("billing", record.Offset)
+			sent = append(sent, record.Offset)
+		}
+		for _, off := range acks {
+			require.NoError(t, a.Ack("billing", off))
+		}
+		return sent
+	}
+
+	a := NewAckTracker(offsets)
+	require.Equal(t, []uint64{0, 1}, stream(a, 2, 0))
+	require.Equal(t, []uint64{1, 2}, stream(a, 2, 1))
+	// an ack behind an unacked record doesn't move the resume point past it
+	require.Equal(t, []uint64{2, 3}, stream(a, 2, 3))
+	require.Equal(t, ErrAckNotSent, a.Ack("billing", 3))
+	require.Equal(t, ErrAckNotSent, a.Ack("billing", 0))
+	require.Equal(t, ErrAckNotSent, a.Ack("search", 0))
+
+	require.NoError(t, offsets.Close())
+	offsets, err = NewOffsetStore(path.Join(dir, "offsets"))
+	require.NoError(t, err)
+	defer offsets.Close()
+	a = NewAckTracker(offsets)
+	require.Equal(t, []uint64{2, 3}, stream(a, 2, 3, 2))
+	off, err := a.Resume("billing", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// without an offset store consumers start where they ask to
+	a = NewAckTracker(nil)
+	off, err = a.Resume("billing", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+/*
+ackedStream fakes a ConsumeAcked server stream: Recv returns what's sent on recv until it's closed, and Send passes
+responses to sent.
+*/
+type ackedStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *api.ConsumeAckRequest
+	sent chan *api.ConsumeResponse
+}
+
+func newAckedStream(ctx context.Context) *ackedStream {
+	return &ackedStream{
+		ctx:  ctx,
+		recv: make(chan *api.ConsumeAckRequest, 4),
+		sent: make(chan *api.ConsumeResponse, 16),
+	}
+}
+
+func (s *ackedStream) Context() context.Context { return s.ctx }
+
+func (s *ackedStream) Recv() (*api.ConsumeAckRequest, error) {
+	req, ok := <-s.recv
+	if !ok {
+		return nil, io.EOF
+	}
+	return req, nil
+}
+
+func (s *ackedStream) Send(res *api.ConsumeResponse) error {
+	s.sent <- res
+	return nil
+}
+
+/*
+TestAckTrackerServe runs ConsumeAcked streams against a fake stream and checks a consumer that disconnects without
+acking a record gets it again on its next stream.
+*/
+func TestAckTrackerServe(t *testing.T) {
+	l, err := NewMemLog(Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 4; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	consume := func(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+		record, err := l.Read(req.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ConsumeResponse{Record: record}, nil
+	}
+	a := NewAckTracker(nil)
+
+	// serve runs a stream in the background, returning the error Serve returns on done
+	serve := func(stream *ackedStream) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- a.Serve(stream, consume) }()
+		return done
+	}
+
+	// ack the first record and close the stream, leaving the second unacked
+	stream := newAckedStream(context.Background())
+	stream.recv <- &api.ConsumeAckRequest{Consumer: "billing", Start: &api.ConsumeRequest{Offset: 0}}
+	done := serve(stream)
+	require.Equal(t, uint64(0), (<-stream.sent).Record.Offset)
+	require.Equal(t, uint64(1), (<-stream.sent).Record.Offset)
+	stream.recv <- &api.ConsumeAckRequest{Ack: 0}
+	close(stream.recv)
+	require.NoError(t, <-done)
+
+	// the next stream starts from the unacked record whatever the client asks for, and fails on a bad ack
+	stream = newAckedStream(context.Background())
+	stream.recv <- &api.ConsumeAckRequest{Consumer: "billing", Start: &api.ConsumeRequest{Offset: 3}}
+	done = serve(stream)
+	require.Equal(t, uint64(1), (<-stream.sent).Record.Offset)
+	stream.recv <- &api.ConsumeAckRequest{Ack: 0}
+	require.Equal(t, ErrAckNotSent, <-done)
+
+	// a new consumer without a start message reads from the beginning until its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	stream = newAckedStream(ctx)
+	stream.recv <- &api.ConsumeAckRequest{Consumer: "search"}
+	done = serve(stream)
+	require.Equal(t, uint64(0), (<-stream.sent).Record.Offset)
+	cancel()
+	require.NoError(t, <-done)
+
+	// a stream closed before its first message never starts
+	stream = newAckedStream(context.Background())
+	close(stream.recv)
+	require.Equal(t, io.EOF, <-serve(stream))
+}
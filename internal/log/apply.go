@@ -0,0 +1,75 @@
+package log
+
+import "io"
+
+/*
+ApplyConfig changes the settings of an open log that can change without reopening it: Segment.MaxStoreBytes,
+Segment.TrimOnSeal and CompactDirtyRatio. The rest of c is ignored. The active segment rolls on its next append if
+it's over the new MaxStoreBytes. Lowering it also schedules the sealed segments that are over it to be split down to
+it by the next Compact, keeping their offsets; sparsely indexed ones are left as they are.
+*/
+func (l *Log) ApplyConfig(c Config) error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	max := c.Segment.MaxStoreBytes
+	if max == 0 {
+		max = l.Config.Segment.MaxStoreBytes
+	}
+	if max < l.Config.Segment.MaxStoreBytes {
+		l.resplit = true
+	}
+	l.Config.Segment.MaxStoreBytes = max
+	l.Config.Segment.TrimOnSeal = c.Segment.TrimOnSeal
+	l.Config.CompactDirtyRatio = c.CompactDirtyRatio
+	l.activeSegment.config.Segment.MaxStoreBytes = max
+	l.activeSegment.config.Segment.TrimOnSeal = c.Segment.TrimOnSeal
+	return nil
+}
+
+/*
+splitOversized splits the sealed segments that grew past Config.Segment.MaxStoreBytes before their last record, as
+only happens when it was lowered, into segments within it. Callers must hold the write lock.
+*/
+func (l *Log) splitOversized() error {
+	max := l.Config.Segment.MaxStoreBytes
+	for i := 0; i < len(l.segments); i++ {
+		s := l.segments[i]
+		if s == l.activeSegment || s.indexEvery() > 1 {
+			continue
+		}
+		oversized, err := s.oversized(max)
+		if err != nil {
+			return err
+		}
+		if !oversized {
+			continue
+		}
+		n := len(l.segments)
+		if err = l.rewrite(i, 1, max); err != nil {
+			return err
+		}
+		i += len(l.segments) - n
+	}
+	return l.saveManifest()
+}
+
+/*
+oversized reports whether the segment already held max store bytes before its last record, so it would have rolled
+sooner with that limit.
+*/
+func (s *segment) oversized(max uint64) (bool, error) {
+	_, pos, err := s.index.Read(-1)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if pos == tombstone {
+		return s.store.size > max, nil
+	}
+	return pos >= max, nil
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-apply-config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 6)
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 13)
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Delete(rollOffset+7))
+
+	// nothing's split until the next maintenance pass
+	lower := rollConfig(t, 2)
+	require.NoError(t, l.ApplyConfig(lower))
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Compact())
+
+	var bases []uint64
+	for _, s := range l.segments {
+		bases = append(bases, s.baseOffset)
+	}
+	// the deleted record takes up no store bytes so its neighbours share a segment
+	require.Equal(t, []uint64{16, 18, 20, 22, 25, 27, 28}, bases)
+	check := func(l *Log) {
+		t.Helper()
+		for off := uint64(rollOffset); off < rollOffset+13; off++ {
+			record, err := l.Read(off)
+			if off == rollOffset+7 {
+				require.Equal(t, ErrRecordDeleted, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+		}
+	}
+	check(l)
+
+	// a second pass has nothing left to split, and the active segment rolls at the new limit
+	require.NoError(t, l.Compact())
+	requireSegments(t, l, 7)
+	appendRolls(t, l, 1)
+	requireSegments(t, l, 8)
+	require.NoError(t, l.Close())
+
+	l, err = newTestLog(dir, lower)
+	require.NoError(t, err)
+	defer l.Close()
+	requireSegments(t, l, 8)
+	check(l)
+}
@@ -0,0 +1,62 @@
+package log
+
+import (
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+// asyncQueueLen is how many appends AppendAsync queues before it blocks
+const asyncQueueLen = 128
+
+type asyncAppend struct {
+	record *api.Record
+	cb     func(offset uint64, err error)
+}
+
+/*
+AppendAsync queues the record to be appended in the background and calls cb with its offset, or the error appending
+it, once it's committed: appended and, under SyncAlways, synced. Records are appended and callbacks called one at a
+time in the order AppendAsync was called, from a single goroutine, so callbacks should be quick. Close waits for that
+goroutine, so callbacks mustn't call Close, Remove or Reset, nor AppendAsync, which can block on a full queue only the
+goroutine drains; either deadlocks. It only blocks if the queue's full. Close appends whatever is still queued before
+closing the log; after that cb is called with ErrLogClosed straight away.
+*/
+func (l *Log) AppendAsync(record *api.Record, cb func(offset uint64, err error)) {
+	l.asyncMu.Lock()
+	defer l.asyncMu.Unlock()
+	l.mu.RLock()
+	closed := l.closed
+	l.mu.RUnlock()
+	if closed {
+		cb(0, ErrLogClosed)
+		return
+	}
+	if l.async == nil {
+		l.async = make(chan asyncAppend, asyncQueueLen)
+		l.asyncDone = make(chan struct{})
+		go l.appendQueued(l.async, l.asyncDone)
+	}
+	l.async <- asyncAppend{record: record, cb: cb}
+}
+
+/*
+appendQueued appends the queued records until queue is closed and drained, then closes done.
+*/
+func (l *Log) appendQueued(queue chan asyncAppend, done chan struct{}) {
+	defer close(done)
+	for a := range queue {
+		off, err := l.Append(a.record)
+		a.cb(off, err)
+	}
+}
+
+/*
+stopAsync stops the worker behind AppendAsync once it has appended everything queued. Callers must hold asyncMu.
+*/
+func (l *Log) stopAsync() {
+	if l.async == nil {
+		return
+	}
+	close(l.async)
+	<-l.asyncDone
+	l.async, l.asyncDone = nil, nil
+}
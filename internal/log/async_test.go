@@ -0,0 +1,64 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogAppendAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-append-async-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Store.SyncPolicy = SyncAlways
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+
+	// more than the queue holds, so some callers block
+	const n = asyncQueueLen * 2
+	var mu sync.Mutex
+	var offsets []uint64
+	var errs []error
+	for i := 0; i < n; i++ {
+		l.AppendAsync(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))}, func(off uint64, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			offsets = append(offsets, off)
+		})
+	}
+	// closing appends the rest of the queue and stops the worker
+	require.NoError(t, l.Close())
+	require.Nil(t, l.async)
+	require.Empty(t, errs)
+	require.Len(t, offsets, n)
+	for i, off := range offsets {
+		require.Equal(t, uint64(i), off)
+	}
+
+	var closedErr error
+	l.AppendAsync(&api.Record{Value: []byte("late")}, func(off uint64, err error) {
+		closedErr = err
+	})
+	require.Equal(t, ErrLogClosed, closedErr)
+	require.Nil(t, l.async)
+
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < n; i++ {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
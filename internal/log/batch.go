@@ -0,0 +1,46 @@
+package log
+
+import (
+	"errors"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+const tokenVersion = 1
+
+var ErrBadToken = errors.New("log: bad continuation token")
+
+/*
+Token returns the continuation token that starts a ConsumeBatch at off. Clients treat tokens as opaque and only hand
+back the ones they were given.
+*/
+func Token(off uint64) []byte {
+	token := make([]byte, 1+8)
+	token[0] = tokenVersion
+	enc.PutUint64(token[1:], off)
+	return token
+}
+
+func parseToken(token []byte) (uint64, error) {
+	if len(token) != 1+8 || token[0] != tokenVersion {
+		return 0, ErrBadToken
+	}
+	return enc.Uint64(token[1:]), nil
+}
+
+/*
+ConsumeBatch reads the batch of records the token continues from, up to maxBytes like ReadUpToBytes, and returns them
+with the token for the next batch. Once the client has caught up the batch is empty and the token is the one it gave,
+so clients can paginate through the log without the server keeping any state for them.
+*/
+func (l *Log) ConsumeBatch(token []byte, maxBytes int) ([]*api.Record, []byte, error) {
+	off, err := parseToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, next, err := l.ReadUpToBytes(off, maxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, Token(next), nil
+}
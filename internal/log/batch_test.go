@@ -0,0 +1,58 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogConsumeBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-consume-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 3))
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %04d", i))})
+		require.NoError(t, err)
+	}
+	requireSegments(t, l, 4)
+
+	var got []string
+	token := Token(rollOffset)
+	for {
+		records, next, err := l.ConsumeBatch(token, 60)
+		require.NoError(t, err)
+		if len(records) == 0 {
+			// caught up
+			require.Equal(t, token, next)
+			break
+		}
+		require.LessOrEqual(t, len(records), 3)
+		for _, record := range records {
+			got = append(got, string(record.Value))
+		}
+		token = next
+	}
+	require.Len(t, got, 10)
+	for i, value := range got {
+		require.Equal(t, fmt.Sprintf("record %04d", i), value)
+	}
+
+	// the token picks up records appended since
+	_, err = l.Append(&api.Record{Value: []byte("record 0010")})
+	require.NoError(t, err)
+	records, _, err := l.ConsumeBatch(token, 60)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(rollOffset+10), records[0].Offset)
+
+	_, _, err = l.ConsumeBatch([]byte("nope"), 60)
+	require.Equal(t, ErrBadToken, err)
+}
@@ -0,0 +1,220 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+var (
+	ErrSegmentActive       = errors.New("log: segment is active")
+	ErrSegmentsNotAdjacent = errors.New("log: segments aren't adjacent")
+)
+
+/*
+Coalesce merges the sealed segments with the given base offsets into as few segments as fit, for cold data where lots
+of small segments just cost file handles and index overhead. The segments have to be adjacent and given in order. Their
+records are copied with their offsets into new segments that roll once their store reaches targetMaxBytes, or their
+index fills up since indexes are still mapped at Config.Segment.MaxIndexBytes. The new segments replace the old ones
+under the log's lock, so readers never see a mix of the two.
+*/
+func (l *Log) Coalesce(baseOffsets []uint64, targetMaxBytes uint64) error {
+	if len(baseOffsets) == 0 {
+		return nil
+	}
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	first, err := l.coalesceRange(baseOffsets)
+	if err != nil {
+		return err
+	}
+	return l.rewrite(first, len(baseOffsets), targetMaxBytes)
+}
+
+/*
+rewrite copies the records of the n segments from l.segments[first] on into new segments that roll at maxBytes and
+swaps them in for the old ones, which have to be sealed and densely indexed. Callers must hold the write lock.
+*/
+func (l *Log) rewrite(first, n int, maxBytes uint64) error {
+	old := l.segments[first : first+n]
+	bases, err := coalesce(l.Dir, old, maxBytes, l.Config)
+	if err != nil {
+		return err
+	}
+	for _, s := range old {
+		if err = s.Close(); err != nil {
+			return err
+		}
+	}
+	// rename the new segments in before removing the old ones, so a crash part way leaves records duplicated
+	// rather than lost
+	reused := make(map[uint64]bool)
+	for _, base := range bases {
+		reused[base] = true
+		for _, ext := range []string{".index", ".store"} {
+			name := path.Join(l.Dir, fmt.Sprintf("%d%s", base, ext))
+			if err = l.Config.fileSystem().Rename(name+defragSuffix, name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range old {
+		if reused[s.baseOffset] {
+			continue
+		}
+		if err = l.Config.fileSystem().Remove(s.index.Name()); err != nil {
+			return err
+		}
+		if err = l.Config.fileSystem().Remove(s.store.Name()); err != nil {
+			return err
+		}
+	}
+	segments := append([]*segment{}, l.segments[:first]...)
+	for _, base := range bases {
+		s, err := newSegment(l.Dir, base, l.Config)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, s)
+	}
+	l.setSegments(append(segments, l.segments[first+len(old):]...))
+	l.recount()
+	return nil
+}
+
+/*
+coalesceRange checks that the base offsets name adjacent sealed segments in order and returns the first one's index
+in l.segments.
+*/
+func (l *Log) coalesceRange(baseOffsets []uint64) (int, error) {
+	first := -1
+	for i, off := range baseOffsets {
+		local, ok := l.local(off)
+		if !ok {
+			return 0, ErrUnknownSegment
+		}
+		if i == 0 {
+			for j, s := range l.segments {
+				if s.baseOffset == local {
+					first = j
+				}
+			}
+			if first < 0 {
+				return 0, ErrUnknownSegment
+			}
+		}
+		j := first + i
+		if j >= len(l.segments) || l.segments[j].baseOffset != local {
+			return 0, ErrSegmentsNotAdjacent
+		}
+		s := l.segments[j]
+		if s == l.activeSegment {
+			return 0, ErrSegmentActive
+		}
+		if s.indexEvery() > 1 {
+			return 0, ErrSparseIndex
+		}
+	}
+	return first, nil
+}
+
+/*
+coalesce copies the records of segments, in order, into new segment files named with defragSuffix and returns the new
+segments' base offsets. Tombstones are copied too so deleted offsets stay deleted.
+*/
+func coalesce(dir string, segments []*segment, maxBytes uint64, c Config) ([]uint64, error) {
+	var (
+		bases []uint64
+		store *store
+		index Index
+	)
+	next := segments[0].baseOffset
+	for _, s := range segments {
+		entries, err := readAll(s.index)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if store == nil {
+				if store, index, err = createDefragFiles(dir, next, c); err != nil {
+					return nil, err
+				}
+				bases = append(bases, next)
+			}
+			off, pos := s.baseOffset+uint64(e.Off), e.Pos
+			if pos != tombstone {
+				p, err := s.store.Read(pos)
+				if err != nil {
+					return nil, err
+				}
+				if _, pos, err = store.Append(p); err != nil {
+					return nil, err
+				}
+			}
+			if err = index.Write(uint32(off-bases[len(bases)-1]), pos); err != nil {
+				return nil, err
+			}
+			next = off + 1
+			if store.size >= maxBytes || index.Size()+entWidth > c.Segment.MaxIndexBytes {
+				if err = closeDefragFiles(store, index); err != nil {
+					return nil, err
+				}
+				store = nil
+			}
+		}
+	}
+	if store != nil {
+		if err := closeDefragFiles(store, index); err != nil {
+			return nil, err
+		}
+	}
+	return bases, nil
+}
+
+/*
+createDefragFiles creates the store and index files a segment is rewritten into, closing and removing whatever it had
+created if it fails partway.
+*/
+func createDefragFiles(dir string, baseOffset uint64, c Config) (_ *store, _ Index, err error) {
+	name := path.Join(dir, fmt.Sprintf("%d", baseOffset))
+	storeName, indexName := name+".store"+defragSuffix, name+".index"+defragSuffix
+	storeFile, err := c.fileSystem().OpenFile(storeName, c.storeOpenFlags()|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.fileSystem().Remove(storeName)
+		}
+	}()
+	store, err := newStore(storeFile, c)
+	if err != nil {
+		storeFile.Close()
+		return nil, nil, err
+	}
+	indexFile, err := c.fileSystem().OpenFile(indexName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	index, err := openIndex(indexFile, c)
+	if err != nil {
+		indexFile.Close()
+		store.Close()
+		c.fileSystem().Remove(indexName)
+		return nil, nil, err
+	}
+	return store, index, nil
+}
+
+func closeDefragFiles(store *store, index Index) error {
+	err := store.Close()
+	if ierr := index.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogCoalesce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-coalesce-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		// the same size as a rollRecord
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %04d", i))})
+		require.NoError(t, err)
+	}
+	requireSegments(t, l, 4)
+	require.NoError(t, l.Delete(rollOffset+4))
+
+	err = l.Coalesce([]uint64{rollOffset, rollOffset + 6}, c.Segment.MaxStoreBytes*10)
+	require.Equal(t, ErrSegmentsNotAdjacent, err)
+	err = l.Coalesce([]uint64{rollOffset + 6, rollOffset + 9}, c.Segment.MaxStoreBytes*10)
+	require.Equal(t, ErrSegmentActive, err)
+	err = l.Coalesce([]uint64{rollOffset + 1}, c.Segment.MaxStoreBytes*10)
+	require.Equal(t, ErrUnknownSegment, err)
+
+	bases := []uint64{rollOffset, rollOffset + 3, rollOffset + 6}
+	require.NoError(t, l.Coalesce(bases, c.Segment.MaxStoreBytes*10))
+	requireSegments(t, l, 2)
+
+	check := func(l *Log) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			off := uint64(rollOffset + i)
+			record, err := l.Read(off)
+			if i == 4 {
+				require.Equal(t, ErrRecordDeleted, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, fmt.Sprintf("record %04d", i), string(record.Value))
+		}
+	}
+	check(l)
+	off, err := l.Append(&api.Record{Value: []byte("k")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+10), off)
+
+	require.NoError(t, l.Close())
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	requireSegments(t, l, 2)
+	check(l)
+}
+
+func TestLogCoalesceTargetMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-coalesce-target-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 2)
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 6)
+	requireSegments(t, l, 4)
+
+	// three segments of two records into segments of up to four
+	bases := []uint64{rollOffset, rollOffset + 2, rollOffset + 4}
+	require.NoError(t, l.Coalesce(bases, c.Segment.MaxStoreBytes*2))
+	requireSegments(t, l, 3)
+	l.mu.RLock()
+	require.Equal(t, uint64(rollOffset), l.segments[0].baseOffset)
+	require.Equal(t, uint64(rollOffset+4), l.segments[1].baseOffset)
+	l.mu.RUnlock()
+	for off := uint64(rollOffset); off < rollOffset+6; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
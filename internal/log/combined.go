@@ -0,0 +1,261 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	combinedMagic = []byte("PLCS")
+
+	ErrCombinedFull   = errors.New("log: combined store has no free segment slots")
+	ErrSegmentSealed  = errors.New("log: segment is sealed")
+	ErrUnknownSegment = errors.New("log: unknown segment")
+)
+
+const (
+	// magic, padding and segment count
+	combinedHeaderWidth = 16
+	// base offset, start position and size of each segment
+	combinedEntryWidth = 24
+)
+
+/*
+CombinedStore is a prototype of keeping many segments' stores in one file for filesystems that penalize lots of small
+files. The file starts with a fixed size table with a slot per segment recording where the segment's region starts and
+how many bytes it holds. Only the newest segment can be appended to, so regions are laid out back to back and rolling
+starts a new region at the end of the file.
+*/
+type CombinedStore struct {
+	mu       sync.Mutex
+	file     *os.File
+	slots    uint64
+	segments []*CombinedSegment
+}
+
+/*
+CombinedSegment is one segment's region of a CombinedStore. It has the same methods as store, with positions relative
+to the start of the region.
+*/
+type CombinedSegment struct {
+	parent     *CombinedStore
+	slot       uint64
+	baseOffset uint64
+	start      uint64
+	size       uint64
+}
+
+/*
+OpenCombinedStore opens or creates the combined file at name with room for up to slots segments.
+*/
+func OpenCombinedStore(name string, slots uint64) (c *CombinedStore, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	c = &CombinedStore{file: f, slots: slots}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		header := make([]byte, c.tableWidth())
+		copy(header, combinedMagic)
+		enc.PutUint64(header[8:], slots)
+		if _, err = f.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	header := make([]byte, combinedHeaderWidth)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(combinedMagic)], combinedMagic) {
+		return nil, fmt.Errorf("log: %s is not a combined store", name)
+	}
+	c.slots = enc.Uint64(header[8:])
+	// a corrupt slot count mustn't have us allocate a table bigger than the file
+	if c.slots > (uint64(fi.Size())-combinedHeaderWidth)/combinedEntryWidth {
+		return nil, fmt.Errorf("log: %s table of %d slots runs past the end of the file", name, c.slots)
+	}
+	table := make([]byte, c.slots*combinedEntryWidth)
+	if _, err = f.ReadAt(table, combinedHeaderWidth); err != nil {
+		return nil, err
+	}
+	for slot := uint64(0); slot < c.slots; slot++ {
+		entry := table[slot*combinedEntryWidth:]
+		start := enc.Uint64(entry[8:])
+		if start == 0 {
+			break
+		}
+		c.segments = append(c.segments, &CombinedSegment{
+			parent:     c,
+			slot:       slot,
+			baseOffset: enc.Uint64(entry),
+			start:      start,
+			size:       enc.Uint64(entry[16:]),
+		})
+	}
+	return c, nil
+}
+
+/*
+Roll seals the newest segment and starts a new one with the given base offset at the end of the file.
+*/
+func (c *CombinedStore) Roll(baseOffset uint64) (*CombinedSegment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slot := uint64(len(c.segments))
+	if slot == c.slots {
+		return nil, ErrCombinedFull
+	}
+	start := c.tableWidth()
+	if slot > 0 {
+		last := c.segments[slot-1]
+		start = last.start + last.size
+	}
+	s := &CombinedSegment{parent: c, slot: slot, baseOffset: baseOffset, start: start}
+	if err := c.writeEntry(s); err != nil {
+		return nil, err
+	}
+	c.segments = append(c.segments, s)
+	return s, nil
+}
+
+/*
+Segment returns the region holding the segment with the given base offset.
+*/
+func (c *CombinedStore) Segment(baseOffset uint64) (*CombinedSegment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.segments {
+		if s.baseOffset == baseOffset {
+			return s, nil
+		}
+	}
+	return nil, ErrUnknownSegment
+}
+
+/*
+BaseOffsets returns the base offsets of the segments in the file in the order they were rolled.
+*/
+func (c *CombinedStore) BaseOffsets() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offsets := make([]uint64, 0, len(c.segments))
+	for _, s := range c.segments {
+		offsets = append(offsets, s.baseOffset)
+	}
+	return offsets
+}
+
+func (c *CombinedStore) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Sync(); err != nil {
+		return err
+	}
+	return c.file.Close()
+}
+
+func (c *CombinedStore) tableWidth() uint64 {
+	return combinedHeaderWidth + c.slots*combinedEntryWidth
+}
+
+func (c *CombinedStore) writeEntry(s *CombinedSegment) error {
+	entry := make([]byte, combinedEntryWidth)
+	enc.PutUint64(entry, s.baseOffset)
+	enc.PutUint64(entry[8:], s.start)
+	enc.PutUint64(entry[16:], s.size)
+	_, err := c.file.WriteAt(entry, int64(combinedHeaderWidth+s.slot*combinedEntryWidth))
+	return err
+}
+
+/*
+Append writes a length-prefixed record to the end of the segment's region and records the region's new size in the
+table. Only the newest segment accepts appends.
+*/
+func (s *CombinedSegment) Append(p []byte) (n uint64, pos uint64, err error) {
+	c := s.parent
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.segments[len(c.segments)-1] != s {
+		return 0, 0, ErrSegmentSealed
+	}
+	b := make([]byte, lenWidth+len(p))
+	enc.PutUint64(b, uint64(len(p)))
+	copy(b[lenWidth:], p)
+	pos = s.size
+	if _, err = c.file.WriteAt(b, int64(s.start+pos)); err != nil {
+		return 0, 0, err
+	}
+	s.size += uint64(len(b))
+	if err = c.writeEntry(s); err != nil {
+		return 0, 0, err
+	}
+	return uint64(len(b)), pos, nil
+}
+
+/*
+Read returns the record stored at the given position in the segment's region.
+*/
+func (s *CombinedSegment) Read(pos uint64) ([]byte, error) {
+	n, err := s.ReadLen(pos)
+	if err != nil {
+		return nil, err
+	}
+	s.parent.mu.Lock()
+	size := s.size
+	s.parent.mu.Unlock()
+	// a corrupt length prefix mustn't have us allocate more than the region holds
+	if end := pos + lenWidth + n; n > size || end > size || end < pos {
+		return nil, fmt.Errorf("%w: record at %d", ErrTornRecord, pos)
+	}
+	b := make([]byte, n)
+	if _, err = s.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *CombinedSegment) ReadLen(pos uint64) (uint64, error) {
+	size := make([]byte, lenWidth)
+	if _, err := s.ReadAt(size, int64(pos)); err != nil {
+		return 0, err
+	}
+	return enc.Uint64(size), nil
+}
+
+/*
+ReadAt reads len(p) bytes from the segment's region beginning at off, without reading past the end of the region.
+*/
+func (s *CombinedSegment) ReadAt(p []byte, off int64) (int, error) {
+	c := s.parent
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if uint64(off)+uint64(len(p)) > s.size {
+		return 0, io.EOF
+	}
+	return c.file.ReadAt(p, int64(s.start)+off)
+}
+
+func (s *CombinedSegment) Name() string {
+	return fmt.Sprintf("%s#%d", s.parent.file.Name(), s.baseOffset)
+}
+
+/*
+Close is a no-op since the file is shared by every segment, close the CombinedStore instead.
+*/
+func (s *CombinedSegment) Close() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCombinedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "combined-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "segments.combined")
+
+	c, err := OpenCombinedStore(name, 2)
+	require.NoError(t, err)
+	first, err := c.Roll(0)
+	require.NoError(t, err)
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		n, pos, err := first.Append(write)
+		require.NoError(t, err)
+		require.Equal(t, width, n)
+		positions = append(positions, pos)
+	}
+
+	second, err := c.Roll(3)
+	require.NoError(t, err)
+	_, _, err = first.Append(write)
+	require.Equal(t, ErrSegmentSealed, err)
+	_, pos, err := second.Append([]byte("second"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), pos)
+	_, err = c.Roll(4)
+	require.Equal(t, ErrCombinedFull, err)
+
+	// regions don't bleed into each other
+	_, err = first.ReadAt(make([]byte, 1), int64(3*width))
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, c.Close())
+
+	c, err = OpenCombinedStore(name, 2)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, []uint64{0, 3}, c.BaseOffsets())
+	first, err = c.Segment(0)
+	require.NoError(t, err)
+	for _, pos := range positions {
+		read, err := first.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	second, err = c.Segment(3)
+	require.NoError(t, err)
+	read, err := second.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), read)
+	_, err = c.Segment(4)
+	require.Equal(t, ErrUnknownSegment, err)
+}
+
+/*
+TestCombinedStoreCorrupt checks a corrupt slot count or length prefix is reported instead of sizing an allocation.
+*/
+func TestCombinedStoreCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "combined-store-corrupt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "segments.combined")
+
+	c, err := OpenCombinedStore(name, 2)
+	require.NoError(t, err)
+	s, err := c.Roll(0)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, 1<<62)
+	_, err = f.WriteAt(b, int64(combinedHeaderWidth+2*combinedEntryWidth))
+	require.NoError(t, err)
+	c, err = OpenCombinedStore(name, 2)
+	require.NoError(t, err)
+	s, err = c.Segment(0)
+	require.NoError(t, err)
+	_, err = s.Read(0)
+	require.True(t, errors.Is(err, ErrTornRecord))
+	require.NoError(t, c.Close())
+
+	_, err = f.WriteAt(b, 8)
+	require.NoError(t, err)
+	_, err = OpenCombinedStore(name, 2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "runs past the end of the file")
+}
@@ -1,9 +1,223 @@
 package log
 
+import (
+	"os"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
 type Config struct {
+	// Clock is where the log gets the time from, the system clock if unset.
+	Clock Clock
+	// OffsetAllocator assigns the offsets the log hands out, which are the segments' contiguous local offsets if
+	// unset.
+	OffsetAllocator OffsetAllocator
+	// OnRoll is called with the log's lock held whenever it rolls to a new active segment, with the old and new
+	// segments' base offsets and one of the Roll reasons.
+	OnRoll func(oldBase, newBase uint64, reason string)
+	// AppendValidator, if set, is called with every record before it's appended. An error rejects the record and is
+	// returned wrapped by Append.
+	AppendValidator func(record *api.Record) error
+	// SegmentRouter, if set, picks the segment each append goes to from the log's segments, oldest first. Offsets
+	// have to stay contiguous so it can only pick the active segment's base offset or ask for a new segment, anything
+	// else fails the append with ErrSegmentSealed or ErrUnknownSegment.
+	SegmentRouter func(record *api.Record, segments []SegmentInfo) (baseOffset uint64, createNew bool)
+	// MaxConcurrentReads bounds the reads through Read and ReadContext in flight at once so a fanout of readers
+	// can't swamp a slow disk. Zero means no limit.
+	MaxConcurrentReads int
+	// MaxConcurrentAppends bounds the appends in flight at once, counting the ones waiting on the log's lock. Append
+	// waits for a free slot and TryAppend gives up if there isn't one. Zero means no limit.
+	MaxConcurrentAppends int
+	// MaxOpenSegments bounds how many segments have their files open at once. Past it the files of the least recently
+	// used sealed segments are closed, to be reopened when they're next read; the active segment's stay open. Zero
+	// means no limit. It doesn't apply to in-memory logs.
+	MaxOpenSegments int
+	// MonotonicTimestamps rejects appends whose timestamp is older than the last record's by more than
+	// OutOfOrderWindow.
+	MonotonicTimestamps bool
+	OutOfOrderWindow    time.Duration
+	// CompactDirtyRatio is the fraction of a segment's bytes that have to belong to deleted records before Compact
+	// defragments it. Zero disables compaction.
+	CompactDirtyRatio float64
+	// WriteOrder is which of the store and index each append writes first, StoreFirst if unset. See WriteOrder for
+	// what a crash between the two leaves behind.
+	WriteOrder WriteOrder
+	// Manifest keeps a manifest of the log's segments in its directory, rewritten when it rolls, truncates, deletes
+	// a record or closes. Opening the log trusts it for sealed segments whose files are still the sizes it lists
+	// so they aren't scanned, and falls back to scanning when it's missing or stale.
+	Manifest bool
+	// StrictOffsets makes appends of records whose offset is already set fail with ErrOffsetPreset unless it's the
+	// offset they'd be appended at, for replicas that set it to catch getting out of step. Records with offset zero
+	// get their offset set as usual.
+	StrictOffsets bool
+	// OnCorruption, if set, is called with the segment's base offset and the record's offset whenever a read finds a
+	// record corrupt, by its checksum in v2 stores or with Segment.VerifyReadOffset, before the read fails with err.
+	// It's called with the log's lock held, for reading or writing depending on what found the corruption, so it
+	// mustn't call back into the log: Truncate, Close or any other method would deadlock. Hand the report off to
+	// another goroutine to act on it.
+	OnCorruption func(segmentBase, offset uint64, err error)
+	// QuarantineCorrupt verifies every sealed segment when the log is opened and, instead of failing, moves the
+	// files of ones that don't open or verify aside with a quarantine suffix and carries on without them. See
+	// Log.Recovery.
+	QuarantineCorrupt bool
+	// CompressInterval, if set, compresses sealed segments in the background this often. See Log.CompressSealed.
+	CompressInterval time.Duration
+	// CompressMinBytes, if set, has Log.CompressSealed leave records of at most this many bytes uncompressed, since
+	// small records barely shrink and still cost CPU to decompress. Each record is marked with whether it was.
+	CompressMinBytes uint64
+	// CreateDir decides whether NewLog creates the log's directory, with DirMode, when it doesn't exist. It's a
+	// pointer so unset can mean true, point it at false to have a missing directory fail instead.
+	CreateDir *bool
+	DirMode   os.FileMode
+	// InMemory keeps the log's files in memory instead of on disk, for tests and ephemeral logs. The directory is
+	// only a name then and everything is lost on close. NewLog refuses Segment.NewIndex and Store.Syncer with it since
+	// there's no *os.File to give them, and MaxOpenSegments doesn't apply. See NewMemLog.
+	InMemory bool
+	// fs is where the log's files are, set by NewLog for in-memory logs and handed on to the logs copied from them.
+	fs fileSystem
 	Segment struct{
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexEvery makes the index sparse by only storing an entry for every Nth record. Reads scan forward in the
+		// store from the nearest indexed record. Zero or one indexes every record.
+		IndexEvery uint64
+		// TrimOnSeal truncates a segment's store file to its logical size when the log rolls past it, reclaiming any
+		// space past the last record, say when the index filled up first with lots of tiny records. Segments rolled
+		// on their store size are already at about their logical size; their index file stays mapped at
+		// MaxIndexBytes until the segment is closed either way.
+		TrimOnSeal bool
+		// VerifyReadOffset checks every record read has the offset it was read at, failing the read with
+		// ErrOffsetMismatch if the index has drifted from the store.
+		VerifyReadOffset bool
+		// NewIndex opens the index for a segment's index file, a memory-mapped index if unset.
+		NewIndex func(f *os.File, c Config) (Index, error)
+	}
+	Store struct {
+		// Encrypter, if set, encrypts record payloads before they're written to the store.
+		Encrypter Encrypter
+		// FormatVersion is the file format new stores are created with, FormatV1 if unset. Existing stores are read
+		// in whatever format they were written in but only accept appends if it matches.
+		FormatVersion uint8
+		// Unbuffered writes appends straight to the store's file instead of buffering them until the next read, sync
+		// or close.
+		Unbuffered bool
+		// AllowStale lets reads of records already flushed skip flushing appends still in the buffer. See
+		// StalePolicy.
+		AllowStale StalePolicy
+		// SyncPolicy decides when segments are fsynced, SyncNone if unset. SyncInterval is the period for the
+		// SyncInterval policy.
+		SyncPolicy   SyncPolicy
+		SyncInterval time.Duration
+		// MaxSyncDelay, if set, bounds how long an append goes unsynced whatever the SyncPolicy: the active segment
+		// is synced in the background once its oldest unsynced append is this old, and segments are synced when the
+		// log rolls past them.
+		MaxSyncDelay time.Duration
+		// Preallocate reserves each store's file up to MaxStoreBytes when it's opened, with fallocate on Linux and
+		// not at all elsewhere, so appends overwrite reserved blocks instead of growing the file. The file is
+		// truncated to the records' size on close.
+		Preallocate bool
+		// Syncer commits a store's file to stable storage, (*os.File).Sync if unset.
+		Syncer func(f *os.File) error
+		// Pipelines are the chains of transformers record payloads can be encoded with, by tag, and PipelineTag
+		// picks the one new records go through. Every record in a store created while Pipelines is set starts with
+		// the tag of the pipeline that encoded it so pipelines can be swapped as long as the old ones are kept
+		// around to decode with. Tag zero stores records as they are. Pipelines need the v2 format, which has room
+		// to mark stores as tagged, and run inside Encrypter.
+		Pipelines   map[uint8][]Transformer
+		PipelineTag uint8
+		// codec is what new stores compress their records with. It's only set for the compressed copies of sealed
+		// segments.
+		codec uint8
+	}
+}
+
+/*
+SegmentInfo is what a SegmentRouter knows about a segment. Every segment but the active one is sealed.
+*/
+type SegmentInfo struct {
+	BaseOffset uint64
+	NextOffset uint64
+	StoreBytes uint64
+	Sealed     bool
+}
+
+/*
+OffsetAllocator maps the contiguous local offsets segments and their indexes work with to the offsets the log hands
+out, for example to make offsets globally unique across shards with shardID<<48 | local. Local maps an offset back,
+reporting false for offsets the allocator couldn't have produced.
+*/
+type OffsetAllocator interface {
+	Offset(local uint64) uint64
+	Local(off uint64) (uint64, bool)
+}
+
+/*
+Clock tells the time. Tests can swap in a fake one to control timestamps and retention.
+*/
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+/*
+storeFlags returns the header flags for stores created with the config.
+*/
+func (c Config) storeFlags() uint8 {
+	if c.Store.Pipelines != nil {
+		return flagTagged
+	}
+	return 0
+}
+
+/*
+storeOpenFlags returns the flags to open store files with. Preallocated stores write at their size rather than at the
+end of the file.
+*/
+func (c Config) storeOpenFlags() int {
+	if c.Store.Preallocate {
+		return os.O_RDWR | os.O_CREATE
+	}
+	return os.O_RDWR | os.O_CREATE | os.O_APPEND
+}
+
+func (c Config) createDir() bool {
+	return c.CreateDir == nil || *c.CreateDir
+}
+
+func (c Config) dirMode() os.FileMode {
+	if c.DirMode == 0 {
+		return 0755
+	}
+	return c.DirMode
+}
+
+func (c Config) fileSystem() fileSystem {
+	if c.fs == nil {
+		return osFS{}
+	}
+	return c.fs
+}
+
+/*
+offset maps a local offset to the log offset Config.OffsetAllocator hands out for it.
+*/
+func (c Config) offset(local uint64) uint64 {
+	if c.OffsetAllocator == nil {
+		return local
+	}
+	return c.OffsetAllocator.Offset(local)
+}
+
+func (c Config) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
 	}
+	return c.Clock
 }
@@ -0,0 +1,134 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+var ErrNotReady = errors.New("log: no record at the consumer's position yet")
+
+/*
+ConsumerConfig configures a Consumer.
+*/
+type ConsumerConfig struct {
+	// Block makes Next wait for a record to be appended when the consumer has caught up with the log, rather than
+	// returning ErrNotReady.
+	Block bool
+}
+
+/*
+Consumer reads a log's records in order from a cursor it keeps itself, following the log across segment rolls.
+Deleted records, gaps between segments and records truncated away from under the cursor are skipped. A Consumer isn't
+safe for concurrent use.
+*/
+type Consumer struct {
+	l      *Log
+	config ConsumerConfig
+	// next is the local offset Next reads from
+	next uint64
+}
+
+/*
+Consumer returns a Consumer positioned at the lowest offset.
+*/
+func (l *Log) Consumer(c ConsumerConfig) *Consumer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return &Consumer{l: l, config: c, next: l.segments[0].baseOffset}
+}
+
+/*
+Seek moves the consumer to off. Offsets below the lowest one clamp to it, and offsets past the highest one leave the
+consumer waiting for them to be appended.
+*/
+func (c *Consumer) Seek(off uint64) error {
+	local, ok := c.l.local(off)
+	if !ok {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	c.l.mu.RLock()
+	defer c.l.mu.RUnlock()
+	if c.l.closed {
+		return ErrLogClosed
+	}
+	if lowest := c.l.segments[0].baseOffset; local < lowest {
+		local = lowest
+	}
+	c.next = local
+	return nil
+}
+
+/*
+Position returns the offset the consumer reads from next.
+*/
+func (c *Consumer) Position() uint64 {
+	return c.l.offset(c.next)
+}
+
+/*
+Next returns the record at the consumer's position, or the first one after it that's still in the log, and moves past
+it.
+*/
+func (c *Consumer) Next() (*api.Record, error) {
+	return c.NextContext(context.Background())
+}
+
+/*
+NextContext is Next, giving up when ctx is done if the consumer blocks.
+*/
+func (c *Consumer) NextContext(ctx context.Context) (*api.Record, error) {
+	l := c.l
+	for {
+		l.mu.RLock()
+		if l.closed {
+			l.mu.RUnlock()
+			return nil, ErrLogClosed
+		}
+		appended := l.appended
+		record, off, err := l.liveAfter(c.next)
+		l.mu.RUnlock()
+		if err == nil {
+			c.next = off + 1
+			record.Offset = l.offset(off)
+			atomic.AddUint64(&l.reads, 1)
+			return record, nil
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+		if !c.config.Block {
+			return nil, ErrNotReady
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/*
+liveAfter returns the first record at or after the local offset that hasn't been deleted, and its local offset, or
+io.EOF if there isn't one in the log yet. Callers must hold the lock.
+*/
+func (l *Log) liveAfter(local uint64) (*api.Record, uint64, error) {
+	for _, s := range l.segments {
+		if s.nextOffset <= local {
+			continue
+		}
+		off := local
+		if off < s.baseOffset {
+			off = s.baseOffset
+		}
+		record, off, err := s.liveAfter(off)
+		if err == io.EOF {
+			continue
+		}
+		return record, off, err
+	}
+	return nil, 0, io.EOF
+}
@@ -0,0 +1,89 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 2))
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 5)
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Delete(rollOffset+3))
+
+	// sequential reads follow the rolls and skip deleted records
+	c := l.Consumer(ConsumerConfig{})
+	require.Equal(t, uint64(rollOffset), c.Position())
+	var read []uint64
+	for {
+		record, err := c.Next()
+		if err == ErrNotReady {
+			break
+		}
+		require.NoError(t, err)
+		read = append(read, record.Offset)
+	}
+	require.Equal(t, []uint64{rollOffset, rollOffset + 1, rollOffset + 2, rollOffset + 4}, read)
+	require.Equal(t, uint64(rollOffset+5), c.Position())
+
+	// seeking before the lowest offset clamps
+	require.NoError(t, c.Seek(0))
+	require.Equal(t, uint64(rollOffset), c.Position())
+	require.NoError(t, c.Seek(rollOffset+2))
+	record, err := c.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+2), record.Offset)
+	require.Equal(t, uint64(rollOffset+3), c.Position())
+
+	// seeking to the tail waits for the next append
+	require.NoError(t, c.Seek(rollOffset+5))
+	_, err = c.Next()
+	require.Equal(t, ErrNotReady, err)
+	appendRolls(t, l, 1)
+	record, err = c.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+5), record.Offset)
+}
+
+func TestConsumerBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumer-block-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 2))
+	require.NoError(t, err)
+	defer l.Close()
+
+	c := l.Consumer(ConsumerConfig{Block: true})
+	require.NoError(t, c.Seek(rollOffset+1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.NextContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	done := make(chan uint64)
+	go func() {
+		record, err := c.Next()
+		require.NoError(t, err)
+		done <- record.Offset
+	}()
+	appendRolls(t, l, 1)
+	select {
+	case <-done:
+		t.Fatal("consumer read a record before its position")
+	case <-time.After(10 * time.Millisecond):
+	}
+	appendRolls(t, l, 1)
+	require.Equal(t, uint64(rollOffset+1), <-done)
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Dump writes the physical layout of the segment to w for debugging corruption: a line per record in the store with its
+position, length prefix, offset and, for stores with checksums, whether it matches. It stops at the first record that
+doesn't add up, a torn tail, a failed checksum, a record that doesn't decode, an offset out of order or one the index
+puts elsewhere, flagging it and returning an error saying what's wrong.
+*/
+func (s *segment) Dump(w io.Writer) error {
+	size := s.store.size
+	if _, err := fmt.Fprintf(
+		w, "segment %d: v%d store %s, %d bytes, codec %d, next offset %d\n",
+		s.baseOffset, s.store.version, s.store.Name(), size, s.store.codec, s.nextOffset,
+	); err != nil {
+		return err
+	}
+	next := s.baseOffset
+	for pos := s.store.start(); pos < size; {
+		line := fmt.Sprintf("pos %d", pos)
+		var n uint64
+		var problem string
+		if pos+lenWidth > size {
+			problem = fmt.Sprintf("torn length prefix, the store ends %d bytes in", size-pos)
+		} else {
+			var err error
+			if n, err = s.store.ReadLen(pos); err != nil {
+				return err
+			}
+			line += fmt.Sprintf(" len %d", n)
+			if end := pos + s.store.width(n); end > size || end < pos {
+				problem = fmt.Sprintf("torn record, the store ends %d bytes in", size-pos)
+			} else {
+				var record *api.Record
+				record, line, problem = s.dumpRecord(pos, next, line)
+				if record != nil {
+					next = record.Offset + 1
+				}
+			}
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		if problem != "" {
+			if _, err := fmt.Fprintf(w, "first inconsistency at position %d: %s\n", pos, problem); err != nil {
+				return err
+			}
+			return fmt.Errorf("segment %d: record at %d: %s", s.baseOffset, pos, problem)
+		}
+		pos += s.store.width(n)
+	}
+	return nil
+}
+
+/*
+dumpRecord reads the whole record at pos for Dump, adding its checksum status and offset to line and checking the
+offset comes at or after next and is where the index says. It returns the record if it decoded and what's wrong with
+it, if anything.
+*/
+func (s *segment) dumpRecord(pos, next uint64, line string) (*api.Record, string, string) {
+	p, err := s.store.Read(pos)
+	if errors.Is(err, ErrChecksumMismatch) {
+		return nil, line + " crc bad", "checksum mismatch"
+	}
+	if s.store.version == FormatV2 {
+		line += " crc ok"
+	}
+	if err != nil {
+		return nil, line, err.Error()
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, line, fmt.Sprintf("doesn't decode: %v", err)
+	}
+	line += fmt.Sprintf(" offset %d", record.Offset)
+	if record.Offset < next || record.Offset >= s.nextOffset {
+		return record, line, fmt.Sprintf("offset out of order, wanted %d to %d", next, s.nextOffset-1)
+	}
+	indexed, err := s.position(record.Offset)
+	switch {
+	case err == ErrRecordDeleted:
+		line += " deleted"
+	case err != nil:
+		return record, line, fmt.Sprintf("not in the index: %v", err)
+	case indexed != pos:
+		return record, line, fmt.Sprintf("the index puts it at %d", indexed)
+	}
+	return record, line, ""
+}
@@ -0,0 +1,71 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-dump-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Store.FormatVersion = FormatV2
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		positions = append(positions, s.store.size)
+		_, err = s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Delete(17))
+
+	var out bytes.Buffer
+	require.NoError(t, s.Dump(&out))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[0], "segment 16: v2 store"))
+	for i, pos := range positions {
+		n, err := s.store.ReadLen(pos)
+		require.NoError(t, err)
+		want := fmt.Sprintf("pos %d len %d crc ok offset %d", pos, n, 16+i)
+		if i == 1 {
+			want += " deleted"
+		}
+		require.Equal(t, want, lines[i+1])
+	}
+	require.NoError(t, s.Close())
+
+	// a record cut off part way through
+	f, err := os.OpenFile(path.Join(dir, "16.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, lenWidth)
+	enc.PutUint64(torn, 100)
+	_, err = f.Write(append(torn, "hello"...))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	tail := s.store.size - lenWidth - 5
+
+	out.Reset()
+	err = s.Dump(&out)
+	require.Error(t, err)
+	lines = strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 6)
+	require.Equal(t, fmt.Sprintf("pos %d len 100", tail), lines[4])
+	require.Equal(t, fmt.Sprintf("first inconsistency at position %d: torn record, the store ends %d bytes in", tail, lenWidth+5), lines[5])
+}
@@ -0,0 +1,23 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+const fadvWillNeed = 3
+
+/*
+fadviseWillNeed tells the kernel we'll read the whole file soon so it starts reading it into the page cache.
+*/
+func fadviseWillNeed(f *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvWillNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package log
+
+import "os"
+
+/*
+fadviseWillNeed is a no-op where we don't have posix_fadvise, or its syscall takes its arguments differently.
+*/
+func fadviseWillNeed(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+fallocate reserves the file's blocks up to size, growing it to size. Filesystems that don't support it are left alone.
+*/
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package log
+
+import "os"
+
+/*
+fallocate is a no-op where we don't have a way to preallocate files.
+*/
+func fallocate(f *os.File, size int64) error {
+	return nil
+}
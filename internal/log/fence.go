@@ -0,0 +1,48 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+var ErrStaleLeader = errors.New("log: stale leader epoch")
+
+/*
+SetEpoch moves the log to a new epoch, which the consensus layer does when leadership changes so a deposed leader's
+AppendEpoch calls fail. Epochs only go up. The epoch isn't persisted: it's zero when the log is opened until it's set.
+*/
+func (l *Log) SetEpoch(epoch uint64) error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if epoch < l.epoch {
+		return fmt.Errorf("%w: epoch %d, log is at %d", ErrStaleLeader, epoch, l.epoch)
+	}
+	l.epoch = epoch
+	return nil
+}
+
+/*
+Epoch returns the log's epoch.
+*/
+func (l *Log) Epoch() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.epoch
+}
+
+/*
+AppendEpoch appends the record like Append if epoch is the log's epoch and fails with ErrStaleLeader otherwise. The
+epoch is checked under the lock the append takes, so no append made in an epoch lands after SetEpoch has moved on.
+*/
+func (l *Log) AppendEpoch(epoch uint64, record *api.Record) (uint64, error) {
+	if l.appendSlots != nil {
+		l.appendSlots <- struct{}{}
+		defer func() { <-l.appendSlots }()
+	}
+	return l.append(record, &epoch)
+}
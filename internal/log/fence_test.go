@@ -0,0 +1,42 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogAppendEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-append-epoch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 2))
+	require.NoError(t, err)
+	defer l.Close()
+
+	off, err := l.AppendEpoch(0, rollRecord())
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset), off)
+
+	// leadership moves on and the old leader's writes are refused
+	require.NoError(t, l.SetEpoch(3))
+	require.Equal(t, uint64(3), l.Epoch())
+	_, err = l.AppendEpoch(2, rollRecord())
+	require.True(t, errors.Is(err, ErrStaleLeader))
+	_, err = l.AppendEpoch(4, rollRecord())
+	require.True(t, errors.Is(err, ErrStaleLeader))
+	off, err = l.AppendEpoch(3, rollRecord())
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+1), off)
+	requireMemRecords(t, l, rollOffset, rollOffset+1)
+
+	require.True(t, errors.Is(l.SetEpoch(2), ErrStaleLeader))
+	require.Equal(t, uint64(3), l.Epoch())
+	// unfenced appends carry on regardless
+	_, err = l.Append(rollRecord())
+	require.NoError(t, err)
+}
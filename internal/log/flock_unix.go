@@ -0,0 +1,21 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+flock takes an exclusive advisory lock on the file without waiting, failing with ErrLogLocked if it's held through
+another open file, even one in this process.
+*/
+func flock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLogLocked
+	}
+	return err
+}
@@ -0,0 +1,384 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+file is what stores and indexes need from the files they're kept in, an *os.File or, for in-memory logs, a memFile.
+*/
+type file interface {
+	io.ReadWriteCloser
+	io.ReaderAt
+	io.Seeker
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+/*
+fileSystem is where a log keeps its segment files: the OS, or memory with Config.InMemory.
+*/
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	MkdirAll(name string, perm os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+func writeFile(fs fileSystem, name string, p []byte) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readFile(fs fileSystem, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) { return ioutil.ReadDir(dir) }
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) RemoveAll(name string) error { return os.RemoveAll(name) }
+
+func (osFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error { return os.Chtimes(name, atime, mtime) }
+
+/*
+memFS keeps files in memory. Directories are only names, so removing one removes the files under it. Open files share
+their contents, like files on disk; indexes map a memFile's bytes directly rather than through mmap.
+*/
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+type memData struct {
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memData), dirs: map[string]bool{"/": true, ".": true}}
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, notExist("open", name)
+		}
+		if !fs.dirs[path.Dir(name)] {
+			return nil, notExist("open", name)
+		}
+		d = &memData{modTime: time.Now()}
+		fs.files[name] = d
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.data = d.data[:0]
+		d.mu.Unlock()
+	}
+	return &memFile{memData: d, name: name, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.dirs[name] {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	d, ok := fs.files[name]
+	if !ok {
+		return nil, notExist("stat", name)
+	}
+	return d.info(name), nil
+}
+
+func (fs *memFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	dir = path.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dir] {
+		return nil, notExist("open", dir)
+	}
+	var infos []os.FileInfo
+	for name, d := range fs.files {
+		if path.Dir(name) == dir {
+			infos = append(infos, d.info(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && path.Dir(name) == dir {
+			infos = append(infos, memFileInfo{name: path.Base(name), dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = d
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		delete(fs.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (fs *memFS) RemoveAll(name string) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	prefix := name + "/"
+	for f := range fs.files {
+		if f == name || strings.HasPrefix(f, prefix) {
+			delete(fs.files, f)
+		}
+	}
+	for d := range fs.dirs {
+		if d == name || strings.HasPrefix(d, prefix) {
+			delete(fs.dirs, d)
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) MkdirAll(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name = path.Clean(name); !fs.dirs[name]; name = path.Dir(name) {
+		fs.dirs[name] = true
+	}
+	return nil
+}
+
+func (fs *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	name = path.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, ok := fs.files[name]
+	if !ok {
+		return notExist("chtimes", name)
+	}
+	d.mu.Lock()
+	d.modTime = mtime
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *memData) info(name string) memFileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return memFileInfo{name: path.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+/*
+memFile is an open file of a memFS with its own offset.
+*/
+type memFile struct {
+	*memData
+	name   string
+	off    int64
+	append bool
+	closed bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.append {
+		f.off = int64(len(f.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.data)) {
+		f.grow(end)
+	}
+	n := copy(f.data[f.off:], p)
+	f.off += int64(n)
+	f.modTime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.info(f.name), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size > int64(len(f.data)) {
+		f.grow(size)
+	} else {
+		f.data = f.data[:size]
+	}
+	return nil
+}
+
+/*
+grow extends the file to size with zeros. Callers must hold the lock.
+*/
+func (f *memFile) grow(size int64) {
+	if size <= int64(cap(f.data)) {
+		n := len(f.data)
+		f.data = f.data[:size]
+		for i := n; i < len(f.data); i++ {
+			f.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size*2)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+/*
+bytes returns the file's contents, which indexes use in place of a memory map. The file has to have been grown to its
+final size first, since growing it might move them.
+*/
+func (f *memFile) bytes() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
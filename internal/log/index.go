@@ -3,7 +3,9 @@ package log
 import (
 	"github.com/tysontate/gommap"
 	"io"
+	"math"
 	"os"
+	"sort"
 )
 
 var (
@@ -13,6 +15,47 @@ var (
 
 )
 
+// tombstone is the position stored for entries whose record has been deleted
+const tombstone uint64 = math.MaxUint64
+
+/*
+Index maps offsets relative to a segment's base offset to positions in its store. Read takes an entry number, with -1
+meaning the last entry, and returns io.EOF past the end; Search finds an entry by offset. Size is the number of bytes
+the entries take up and is checked against MaxIndexBytes.
+
+Segments use the optional Sync, SetPos and Reset methods when the index has them to support syncing, deleting
+records and Repair.
+*/
+type Index interface {
+	Write(off uint32, pos uint64) error
+	Read(in int64) (off uint32, pos uint64, err error)
+	Search(off uint32) (in int64, pos uint64, err error)
+	Close() error
+	Name() string
+	Size() uint64
+}
+
+/*
+openIndex opens the index for the given file with the config's NewIndex, falling back to our memory-mapped index, which
+is also what in-memory files get.
+*/
+func openIndex(f file, c Config) (Index, error) {
+	if c.Segment.NewIndex == nil {
+		return newIndex(f, c)
+	}
+	switch osFile := f.(type) {
+	case *os.File:
+		return c.Segment.NewIndex(osFile, c)
+	case *pooledFile:
+		detached, err := osFile.detach()
+		if err != nil {
+			return nil, err
+		}
+		return c.Segment.NewIndex(detached, c)
+	}
+	return newIndex(f, c)
+}
+
 /*
 index defines our index file, which comprises a persisted file and a memory mapped file.
 The size tells us the size of the index and where to write the next entry appended to the index.
@@ -20,9 +63,12 @@ The size tells us the size of the index and where to write the next entry append
 Position of an entry in a file is offset * entWidth
 */
 type index struct {
-	file *os.File
+	file file
+	// mmap is the file's bytes in memory for in-memory files, which aren't mapped
 	mmap gommap.MMap
 	size uint64
+	// readOnly indexes are mapped at the file's size without write access
+	readOnly bool
 }
 
 /*
@@ -30,38 +76,74 @@ newIndex creates an index for the given file. We create the index and save the c
 size of the file so we can track the amount of data in the index file as we add index entries. We grow the file
 to the max index size before memory-mapping the file and then return the created index to the caller.
 */
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f file, c Config) (*index, error) {
 	idx := &index{
 		file: f,
 	}
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
-	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
-	); err != nil {
+	if err = f.Truncate(int64(c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED,
-	); err != nil {
+	if mem, ok := f.(*memFile); ok {
+		idx.mmap = mem.bytes()
+		return idx, nil
+	}
+	// the mapping outlives the file being closed, so pooled index files can be closed once it's mapped
+	if _, err = withOSFile(f, func(osFile *os.File) error {
+		idx.mmap, err = gommap.Map(
+			osFile.Fd(),
+			gommap.PROT_READ|gommap.PROT_WRITE,
+			gommap.MAP_SHARED,
+		)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 
 	return idx, nil
 }
 
+/*
+newReadOnlyIndex maps the index file as it is, without growing it, so it can be read but not written.
+*/
+func newReadOnlyIndex(f *os.File) (*index, error) {
+	idx := &index{
+		file:     f,
+		readOnly: true,
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx.size = uint64(fi.Size())
+	if idx.size == 0 {
+		return idx, nil
+	}
+	if idx.mmap, err = gommap.Map(f.Fd(), gommap.PROT_READ, gommap.MAP_SHARED); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
 /*
 Close makes sure the memory-mapped file has synced its data to the persisted file and that the persisted file has flushed
 its contents to stable storage. Then it truncates the persisted file to the amount of data that's actually
 in it and closes the file.
 */
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	if i.readOnly {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+	if err := i.syncMap(); err != nil {
 		return err
 	}
 
@@ -103,6 +185,9 @@ First, we validate that we have space to write the entry. If there's space, we t
 and write them to the memory mapped file. Then we increment the position were the next write will go.
 */
 func (i *index) Write(off uint32, pos uint64) error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
 	if uint64(len(i.mmap)) < i.size+entWidth {
 		return io.EOF
 	}
@@ -112,7 +197,123 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+/*
+IndexEntry is an index entry: a record's offset relative to the segment's base offset and its position in the store.
+*/
+type IndexEntry struct {
+	Off uint32
+	Pos uint64
+}
+
+/*
+Entries returns every entry in the index in order, decoded straight from the mapped file, for tools migrating or
+debugging indexes. The entries are a copy, so changing them doesn't change the index.
+*/
+func (i *index) Entries() ([]IndexEntry, error) {
+	n := i.size / entWidth
+	if uint64(len(i.mmap)) < n*entWidth {
+		return nil, io.ErrUnexpectedEOF
+	}
+	entries := make([]IndexEntry, 0, n)
+	for p := i.mmap[:n*entWidth]; len(p) > 0; p = p[entWidth:] {
+		entries = append(entries, IndexEntry{Off: enc.Uint32(p), Pos: enc.Uint64(p[offWidth:])})
+	}
+	return entries, nil
+}
+
+/*
+readAll reads the entries of any Index until it runs out.
+*/
+func readAll(i Index) ([]IndexEntry, error) {
+	var entries []IndexEntry
+	for in := int64(0); ; in++ {
+		off, pos, err := i.Read(in)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, IndexEntry{Off: off, Pos: pos})
+	}
+}
+
+/*
+writeEntries writes the entries to w in the index file's format.
+*/
+func writeEntries(w io.Writer, entries []IndexEntry) error {
+	b := make([]byte, entWidth)
+	for _, e := range entries {
+		enc.PutUint32(b, e.Off)
+		enc.PutUint64(b[offWidth:], e.Pos)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Search finds the entry for the given relative offset, which needn't be the entry at that position once deleted records
+have been compacted out of the index. Entries are sorted by offset so we binary search them, returning the entry's
+number along with the record's position.
+*/
+func (i *index) Search(off uint32) (in int64, pos uint64, err error) {
+	n := int(i.size / entWidth)
+	j := sort.Search(n, func(j int) bool {
+		return enc.Uint32(i.mmap[uint64(j)*entWidth:]) >= off
+	})
+	if j == n || enc.Uint32(i.mmap[uint64(j)*entWidth:]) != off {
+		return 0, 0, io.EOF
+	}
+	_, pos, err = i.Read(int64(j))
+	return int64(j), pos, err
+}
+
+/*
+SetPos overwrites the position of an existing entry, which is how deleted records are tombstoned.
+*/
+func (i *index) SetPos(in int64, pos uint64) error {
+	at := uint64(in) * entWidth
+	if i.size < at+entWidth {
+		return io.EOF
+	}
+	enc.PutUint64(i.mmap[at+offWidth:at+entWidth], pos)
+	return nil
+}
+
+/*
+Reset drops every entry so the index can be rewritten from scratch.
+*/
+func (i *index) Reset() error {
+	i.size = 0
+	return nil
+}
+
+/*
+Sync flushes the memory-mapped file to the persisted file and the persisted file to stable storage.
+*/
+func (i *index) Sync() error {
+	if err := i.syncMap(); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
+/*
+syncMap flushes the memory-mapped file, if it's mapped rather than in memory.
+*/
+func (i *index) syncMap() error {
+	if _, ok := i.file.(*memFile); ok {
+		return nil
+	}
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
 
+func (i *index) Size() uint64 {
+	return i.size
+}
@@ -1,11 +1,14 @@
 package log
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"testing"
 	"github.com/stretchr/testify/require"
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestIndex(t *testing.T) {
@@ -53,3 +56,126 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, entries[1].Pos, pos)
 
 }
+
+func TestIndexEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "index-entries-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	entries, err := readAll(s.index)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	var want []IndexEntry
+	var pos uint64
+	for i := 0; i < 5; i++ {
+		record := &api.Record{Value: bytes.Repeat([]byte("x"), i+1)}
+		_, err := s.Append(record)
+		require.NoError(t, err)
+		want = append(want, IndexEntry{Off: uint32(i), Pos: pos})
+		pos += lenWidth + uint64(proto.Size(record))
+	}
+	entries, err = s.IndexEntries()
+	require.NoError(t, err)
+	require.Equal(t, want, entries)
+	// they're a copy
+	entries[0].Pos = 42
+	entries, err = s.index.(*index).Entries()
+	require.NoError(t, err)
+	require.Equal(t, want, entries)
+	// and the same as reading entry by entry
+	entries, err = readAll(s.index)
+	require.NoError(t, err)
+	require.Equal(t, want, entries)
+
+	// sparse indexes only have every Nth record's entry, at the position its append was stored at
+	c.Segment.IndexEvery = 2
+	sparse, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer sparse.Close()
+	want = nil
+	for i := 0; i < 5; i++ {
+		pos := sparse.store.size
+		_, err := sparse.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		if i%2 == 0 {
+			want = append(want, IndexEntry{Off: uint32(i), Pos: pos})
+		}
+	}
+	entries, err = sparse.IndexEntries()
+	require.NoError(t, err)
+	require.Equal(t, want, entries)
+}
+
+// memIndex is a trivial in-memory Index that only keeps the segment's file to report its name
+type memIndex struct {
+	file    *os.File
+	entries []IndexEntry
+}
+
+func (m *memIndex) Write(off uint32, pos uint64) error {
+	m.entries = append(m.entries, IndexEntry{Off: off, Pos: pos})
+	return nil
+}
+
+func (m *memIndex) Read(in int64) (uint32, uint64, error) {
+	if in == -1 {
+		in = int64(len(m.entries)) - 1
+	}
+	if in < 0 || in >= int64(len(m.entries)) {
+		return 0, 0, io.EOF
+	}
+	return m.entries[in].Off, m.entries[in].Pos, nil
+}
+
+func (m *memIndex) Search(off uint32) (int64, uint64, error) {
+	for in, e := range m.entries {
+		if e.Off == off {
+			return int64(in), e.Pos, nil
+		}
+	}
+	return 0, 0, io.EOF
+}
+
+func (m *memIndex) Close() error { return m.file.Close() }
+func (m *memIndex) Name() string { return m.file.Name() }
+func (m *memIndex) Size() uint64 { return uint64(len(m.entries)) * entWidth }
+
+func TestIndexPluggable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "index-pluggable-test")
+	defer os.RemoveAll(dir)
+
+	var opened []*memIndex
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 3 * entWidth
+	c.Segment.NewIndex = func(f *os.File, c Config) (Index, error) {
+		idx := &memIndex{file: f}
+		opened = append(opened, idx)
+		return idx, nil
+	}
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Len(t, opened, 1)
+
+	for i := uint64(0); i < 3; i++ {
+		off, err := s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, 16+i, off)
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+	require.Len(t, opened[0].entries, 3)
+	require.True(t, s.IsMaxed())
+
+	// the in-memory index doesn't support tombstones
+	require.Equal(t, ErrIndexUnsupported, s.Delete(16))
+}
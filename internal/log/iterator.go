@@ -0,0 +1,139 @@
+package log
+
+import (
+	"io"
+	"sync/atomic"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+/*
+Iterator reads a log's records oldest first. Deleted records and gaps between segments are skipped, and Next returns
+io.EOF once it has read the highest offset, so the usual loop of calling Next until io.EOF works. Records appended
+after that are picked up by calling Next again.
+*/
+type Iterator struct {
+	l *Log
+	// next is the local offset to try next
+	next uint64
+	done bool
+}
+
+/*
+Iterator returns an iterator that starts at fromOffset, or the lowest offset if that's higher.
+*/
+func (l *Log) Iterator(fromOffset uint64) *Iterator {
+	it := &Iterator{l: l}
+	local, ok := l.local(fromOffset)
+	if !ok {
+		it.done = true
+	}
+	it.next = local
+	return it
+}
+
+func (it *Iterator) Next() (*api.Record, error) {
+	l := it.l
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	if it.done {
+		return nil, io.EOF
+	}
+	record, off, err := l.liveAfter(it.next)
+	if err != nil {
+		return nil, err
+	}
+	it.next = off + 1
+	record.Offset = l.offset(off)
+	atomic.AddUint64(&l.reads, 1)
+	return record, nil
+}
+
+/*
+ReverseIterator reads a log's records newest first. Deleted records and offsets missing from the log are skipped, and
+Next returns io.EOF, like Iterator, once it has gone past the lowest offset.
+*/
+type ReverseIterator struct {
+	l *Log
+	// next is the local offset to try next
+	next uint64
+	done bool
+}
+
+/*
+ReverseIterator returns an iterator that starts at fromOffset, or the highest offset if that's lower, and works down to
+the lowest offset.
+*/
+func (l *Log) ReverseIterator(fromOffset uint64) *ReverseIterator {
+	it := &ReverseIterator{l: l}
+	local, ok := l.local(fromOffset)
+	if !ok {
+		it.done = true
+	}
+	it.next = local
+	return it
+}
+
+func (it *ReverseIterator) Next() (*api.Record, error) {
+	l := it.l
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	for !it.done {
+		s := it.segment()
+		if s == nil {
+			it.done = true
+			break
+		}
+		off := it.next
+		if off >= s.nextOffset {
+			// past the head of the log or in a gap between segments
+			if s.nextOffset == s.baseOffset {
+				it.step(s.baseOffset)
+				continue
+			}
+			off = s.nextOffset - 1
+		}
+		it.step(off)
+		record, err := s.Read(off)
+		if err == ErrRecordDeleted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		record.Offset = l.offset(off)
+		atomic.AddUint64(&l.reads, 1)
+		return record, nil
+	}
+	return nil, io.EOF
+}
+
+/*
+segment returns the newest segment that starts at or below the next offset, or nil if there isn't one.
+*/
+func (it *ReverseIterator) segment() *segment {
+	segments := it.l.segments
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].baseOffset <= it.next {
+			return segments[i]
+		}
+	}
+	return nil
+}
+
+/*
+step moves the iterator to the offset below off, finishing it if off is zero.
+*/
+func (it *ReverseIterator) step(off uint64) {
+	if off == 0 {
+		it.done = true
+		return
+	}
+	it.next = off - 1
+}
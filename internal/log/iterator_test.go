@@ -0,0 +1,85 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iterator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 3))
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 8)
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Delete(rollOffset+4))
+
+	readAll := func(it *Iterator) []uint64 {
+		t.Helper()
+		var offsets []uint64
+		for {
+			record, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			offsets = append(offsets, record.Offset)
+		}
+		_, err := it.Next()
+		require.Equal(t, io.EOF, err)
+		return offsets
+	}
+	it := l.Iterator(0)
+	require.Equal(t, []uint64{16, 17, 18, 19, 21, 22, 23}, readAll(it))
+	require.Equal(t, []uint64{22, 23}, readAll(l.Iterator(rollOffset+6)))
+	require.Empty(t, readAll(l.Iterator(rollOffset+8)))
+
+	// an iterator that reached the end carries on with records appended since
+	appendRolls(t, l, 1)
+	require.Equal(t, []uint64{24}, readAll(it))
+}
+
+func TestReverseIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reverse-iterator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	c.CompactDirtyRatio = 0.1
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 8)
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Delete(rollOffset+4))
+	require.NoError(t, l.Compact())
+
+	readAll := func(from uint64) []uint64 {
+		t.Helper()
+		it := l.ReverseIterator(from)
+		var offsets []uint64
+		for {
+			record, err := it.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			offsets = append(offsets, record.Offset)
+		}
+		_, err := it.Next()
+		require.Equal(t, io.EOF, err)
+		return offsets
+	}
+	want := []uint64{23, 22, 21, 19, 18, 17, 16}
+	require.Equal(t, want, readAll(rollOffset+100))
+	require.Equal(t, want[2:], readAll(rollOffset+5))
+	require.Equal(t, []uint64{rollOffset}, readAll(rollOffset))
+	require.Empty(t, readAll(rollOffset-1))
+}
@@ -0,0 +1,45 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+)
+
+const lockName = "log.lock"
+
+var ErrLogLocked = errors.New("log: directory is locked by another open log")
+
+/*
+lockDir locks the log's directory with a lock file in it, so a second process opening the same directory, which would
+corrupt it by writing alongside us, fails with ErrLogLocked instead. The lock is advisory and released by unlockDir or
+when the process exits. In-memory logs have nothing to lock.
+*/
+func (l *Log) lockDir() error {
+	if l.Config.InMemory {
+		return nil
+	}
+	f, err := os.OpenFile(path.Join(l.Dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = flock(f); err != nil {
+		f.Close()
+		return err
+	}
+	l.dirLock = f
+	return nil
+}
+
+/*
+unlockDir releases the directory's lock by closing the lock file. The file's left behind since removing it could let
+another process lock a new file by the same name while a third still holds the old one.
+*/
+func (l *Log) unlockDir() error {
+	if l.dirLock == nil {
+		return nil
+	}
+	err := l.dirLock.Close()
+	l.dirLock = nil
+	return err
+}
@@ -0,0 +1,31 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-locked-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	// flock locks belong to the open file, so a second open in this process is refused like one from another
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrLogLocked, err)
+
+	// resetting keeps the directory locked
+	require.NoError(t, l.Reset())
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrLogLocked, err)
+
+	require.NoError(t, l.Close())
+	reopened, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, reopened.Close())
+}
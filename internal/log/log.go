@@ -1,16 +1,22 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	api "github.com/dfcarpenter/proglog/api/v1"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
 )
 
 /*
@@ -18,13 +24,77 @@ Log manages list of segments
 */
 
 type Log struct {
-	mu sync.RWMutex
+	// appends and reads count successful operations, kept first for 64-bit alignment of atomic operations
+	appends, reads uint64
+
+	// wmu serializes the log's writers, which hold mu exclusively as well except while rolling. A roll only takes mu
+	// to swap the new active segment in, so reads carry on while the sealed segment is synced and the new one is
+	// created. See lock.
+	wmu sync.Mutex
+	mu  sync.RWMutex
 	Dir string
 	Config Config
 	activeSegment *segment
 	segments []*segment
+	// bases is the segments' base offsets in order, kept alongside them by addSegment and setSegments so segment can
+	// binary search it
+	bases []uint64
+	// epoch fences appends made with AppendEpoch, see SetEpoch
+	epoch uint64
+	subs []*Subscription
+	nextSubID uint64
+	// lastTimestamp is the latest timestamp of the appended records
+	lastTimestamp int64
+	// appended is closed and replaced whenever a record is appended to wake up waiters
+	appended chan struct{}
+	// stopSync stops the background sync of the SyncInterval policy, syncErr is its last failure
+	stopSync chan struct{}
+	syncErr  error
+	// unsyncedSince is when the oldest append the active segment hasn't synced was made, zero if there isn't one, for
+	// Config.Store.MaxSyncDelay. unsynced wakes its background sync when it's set and stopSyncDelay stops it.
+	unsyncedSince time.Time
+	unsynced      chan struct{}
+	stopSyncDelay chan struct{}
+	// readSlots holds a token for every read in flight when Config.MaxConcurrentReads is set
+	readSlots chan struct{}
+	// appendSlots holds a token for every append in flight when Config.MaxConcurrentAppends is set
+	appendSlots chan struct{}
+	recovery    RecoveryReport
+	// stopCompress stops the background compression started by Config.CompressInterval, compressErr is its last
+	// failure
+	stopCompress chan struct{}
+	compressErr  error
+	// asyncMu guards starting and stopping the worker behind AppendAsync, which takes appends from async and closes
+	// asyncDone once async is closed and drained
+	asyncMu   sync.Mutex
+	async     chan asyncAppend
+	asyncDone chan struct{}
+	// lastAppend is when the last append succeeded, or the log was opened if nothing's been appended since
+	lastAppend time.Time
+	closed     bool
+	// resplit is set by ApplyConfig when sealed segments may be over the store limit, to split them in Compact
+	resplit bool
+	// records is the number of offsets the segments span, see TotalRecords
+	records uint64
+	// dirLock is the open lock file holding the directory's lock, see lockDir
+	dirLock *os.File
 }
 
+var (
+	ErrTooLate   = errors.New("log: record timestamp outside the out-of-order window")
+	ErrLogClosed = errors.New("log: closed")
+)
+
+/*
+Reasons the log rolls to a new active segment, as given to Config.OnRoll.
+*/
+const (
+	RollStoreMaxed = "store-maxed"
+	RollIndexMaxed = "index-maxed"
+	RollManual     = "manual"
+	RollRouted     = "routed"
+)
+
 func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
@@ -32,20 +102,164 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.InMemory && (c.Segment.NewIndex != nil || c.Store.Syncer != nil) {
+		return nil, errors.New("log: Segment.NewIndex and Store.Syncer need files on disk, not InMemory")
+	}
+	if c.InMemory && c.fs == nil {
+		c.fs = newMemFS()
+	}
+	if c.MaxOpenSegments > 0 && !c.InMemory {
+		c.fs = newFilePool(c.fileSystem(), c.MaxOpenSegments)
+	}
 	l := &Log{
 		Dir: dir,
 		Config: c,
+		appended: make(chan struct{}),
+	}
+	if err := l.setup(); err != nil {
+		l.unlockDir()
+		return nil, err
+	}
+	l.lastAppend = c.clock().Now()
+	if c.MaxConcurrentReads > 0 {
+		l.readSlots = make(chan struct{}, c.MaxConcurrentReads)
+	}
+	if c.MaxConcurrentAppends > 0 {
+		l.appendSlots = make(chan struct{}, c.MaxConcurrentAppends)
+	}
+	l.startBackground()
+	return l, nil
+}
+
+/*
+startBackground starts the background syncs and compression the config asks for, which Close stops.
+*/
+func (l *Log) startBackground() {
+	c := l.Config
+	if c.Store.SyncPolicy == SyncInterval && c.Store.SyncInterval > 0 {
+		l.stopSync = make(chan struct{})
+		go l.syncEvery(c.Store.SyncInterval, l.stopSync)
+	}
+	if c.Store.MaxSyncDelay > 0 {
+		l.unsynced = make(chan struct{}, 1)
+		l.stopSyncDelay = make(chan struct{})
+		go l.syncWithin(c.Store.MaxSyncDelay, l.stopSyncDelay)
+	}
+	if c.CompressInterval > 0 {
+		l.stopCompress = make(chan struct{})
+		go l.compressEvery(c.CompressInterval, l.stopCompress)
+	}
+}
+
+/*
+NewMemLog opens a log that keeps its files in memory, as with Config.InMemory. It behaves like any other log but is
+gone once it's closed.
+*/
+func NewMemLog(c Config) (*Log, error) {
+	c.InMemory = true
+	return NewLog("/", c)
+}
+
+/*
+syncEvery syncs the active segment every d until stop is closed. Failures are returned by the next Append.
+*/
+func (l *Log) syncEvery(d time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		l.lock()
+		select {
+		case <-stop:
+			// closed while we waited for the lock
+			l.unlock()
+			return
+		default:
+		}
+		if err := l.activeSegment.Sync(); err != nil {
+			l.syncErr = err
+		}
+		l.unlock()
+	}
+}
+
+/*
+syncWithin syncs the active segment once its oldest unsynced append is d old, see Config.Store.MaxSyncDelay, until
+stop is closed. Failures are returned by the next Append.
+*/
+func (l *Log) syncWithin(d time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-l.unsynced:
+		}
+		for wait := d; wait > 0; {
+			timer := time.NewTimer(wait)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			l.lock()
+			select {
+			case <-stop:
+				l.unlock()
+				return
+			default:
+			}
+			var err error
+			if wait, err = l.syncDue(d); err != nil {
+				l.syncErr = err
+			}
+			l.unlock()
+		}
+	}
+}
+
+/*
+syncDue syncs the active segment if its oldest unsynced append is at least d old by the log's clock, returning how
+much longer it has otherwise. Callers must hold the write lock.
+*/
+func (l *Log) syncDue(d time.Duration) (time.Duration, error) {
+	if l.unsyncedSince.IsZero() {
+		return 0, nil
 	}
-	return l, l.setup()
+	if left := d - l.Config.clock().Now().Sub(l.unsyncedSince); left > 0 {
+		return left, nil
+	}
+	l.unsyncedSince = time.Time{}
+	return 0, l.activeSegment.Sync()
 }
 
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	if err := l.setupDir(); err != nil {
+		return err
+	}
+	if err := l.lockDir(); err != nil {
+		return err
+	}
+	files, err := l.Config.fileSystem().ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		switch path.Ext(file.Name()) {
+		case deletedSuffix, quarantineSuffix, path.Ext(manifestName), path.Ext(lockName):
+			continue
+		case tempSuffix, defragSuffix:
+			// left behind by a crash while creating or defragmenting a segment
+			if err = l.Config.fileSystem().Remove(path.Join(l.Dir, file.Name())); err != nil {
+				return err
+			}
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -57,8 +271,17 @@ func (l *Log) setup() error {
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
+	l.recovery = RecoveryReport{}
+	manifest := l.trustedManifest(baseOffsets)
 	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+		if e, ok := manifest[baseOffsets[i]]; ok && e.sealed && !l.Config.QuarantineCorrupt && e.matches(l.Config.fileSystem(), l.Dir) {
+			err = l.openKnownSegment(e)
+		} else if l.Config.QuarantineCorrupt && i < len(baseOffsets)-2 {
+			err = l.openOrQuarantine(baseOffsets[i])
+		} else {
+			err = l.newSegment(baseOffsets[i])
+		}
+		if err != nil {
 			return err
 		}
 		i++
@@ -70,100 +293,970 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	l.recount()
+	return l.setupTimestamp()
+}
+
+/*
+setupDir creates the log's directory if it's missing, or with Config.CreateDir false explains that it's missing rather
+than letting the first segment fail to open.
+*/
+func (l *Log) setupDir() error {
+	_, err := l.Config.fileSystem().Stat(l.Dir)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if !l.Config.createDir() {
+		return fmt.Errorf("log: directory %s doesn't exist and CreateDir is false: %w", l.Dir, os.ErrNotExist)
+	}
+	return l.Config.fileSystem().MkdirAll(l.Dir, l.Config.dirMode())
+}
+
+/*
+setupTimestamp picks up the latest timestamp for OutOfOrderWindow from the last segment holding records. Records inside
+the window can be older than the ones before them, so it's the latest of the segment's rather than its last record's.
+*/
+func (l *Log) setupTimestamp() error {
+	if !l.Config.MonotonicTimestamps {
+		return nil
+	}
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		found := false
+		for off := s.baseOffset; ; off++ {
+			record, live, err := s.liveAfter(off)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !found || record.Timestamp > l.lastTimestamp {
+				l.lastTimestamp = record.Timestamp
+			}
+			found, off = true, live
+		}
+		if found {
+			break
+		}
+	}
 	return nil
 }
 
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(record)
+	if l.appendSlots != nil {
+		l.appendSlots <- struct{}{}
+		defer func() { <-l.appendSlots }()
+	}
+	return l.append(record, nil)
+}
+
+/*
+TryAppend appends the record like Append unless Config.MaxConcurrentAppends appends are already in flight, in which case
+it returns false straight away so the producer can shed or buffer the record itself.
+*/
+func (l *Log) TryAppend(record *api.Record) (uint64, bool, error) {
+	if l.appendSlots != nil {
+		select {
+		case l.appendSlots <- struct{}{}:
+			defer func() { <-l.appendSlots }()
+		default:
+			return 0, false, nil
+		}
+	}
+	off, err := l.append(record, nil)
+	return off, true, err
+}
+
+/*
+append appends the record. If epoch isn't nil it has to be the log's epoch, see AppendEpoch.
+*/
+func (l *Log) append(record *api.Record, epoch *uint64) (uint64, error) {
+	if v := l.Config.AppendValidator; v != nil {
+		if err := v(record); err != nil {
+			return 0, fmt.Errorf("log: invalid record: %w", err)
+		}
+	}
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	if epoch != nil && *epoch != l.epoch {
+		return 0, fmt.Errorf("%w: epoch %d, log is at %d", ErrStaleLeader, *epoch, l.epoch)
+	}
+	l.activeSegment.stamp(record)
+	if l.Config.MonotonicTimestamps &&
+		record.Timestamp < l.lastTimestamp-int64(l.Config.OutOfOrderWindow) {
+		return 0, ErrTooLate
+	}
+	if err := l.syncErr; err != nil {
+		l.syncErr = nil
+		return 0, err
+	}
+	if err := l.route(record); err != nil {
+		return 0, err
+	}
+	local, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	l.records++
+	off := l.offset(local)
+	record.Offset = off
+	policy := l.Config.Store.SyncPolicy
+	if policy == SyncAlways {
+		if err = l.activeSegment.Sync(); err != nil {
+			return off, err
+		}
+	} else if l.unsynced != nil && l.unsyncedSince.IsZero() {
+		l.unsyncedSince = l.Config.clock().Now()
+		select {
+		case l.unsynced <- struct{}{}:
+		default:
+		}
+	}
+	// records inside the window are older than the latest, which mustn't move back with them
+	if record.Timestamp > l.lastTimestamp {
+		l.lastTimestamp = record.Timestamp
+	}
+	l.lastAppend = l.Config.clock().Now()
+	atomic.AddUint64(&l.appends, 1)
+	l.publish(record)
+	close(l.appended)
+	l.appended = make(chan struct{})
+	if reason := l.activeSegment.maxedBy(); reason != "" {
+		err = l.roll(reason)
 	}
 	return off, err
 }
 
+/*
+route asks Config.SegmentRouter where the record goes and rolls first if it wants a new segment, unless the active
+segment is still empty.
+*/
+func (l *Log) route(record *api.Record) error {
+	if l.Config.SegmentRouter == nil {
+		return nil
+	}
+	infos := make([]SegmentInfo, 0, len(l.segments))
+	for _, s := range l.segments {
+		infos = append(infos, SegmentInfo{
+			BaseOffset: l.offset(s.baseOffset),
+			NextOffset: l.offset(s.nextOffset),
+			StoreBytes: s.store.size,
+			Sealed:     s != l.activeSegment,
+		})
+	}
+	base, createNew := l.Config.SegmentRouter(record, infos)
+	if createNew {
+		if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+			return nil
+		}
+		return l.roll(RollRouted)
+	}
+	for _, info := range infos {
+		if info.BaseOffset != base {
+			continue
+		}
+		if info.Sealed {
+			return ErrSegmentSealed
+		}
+		return nil
+	}
+	return ErrUnknownSegment
+}
+
+/*
+IdleDuration returns how long it's been since the last successful append, or since the log was opened if there hasn't
+been one, by the config's clock.
+*/
+func (l *Log) IdleDuration() time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.Config.clock().Now().Sub(l.lastAppend)
+}
+
+/*
+Flush writes the active segment's buffered appends to its store file without syncing it, a cheaper way than a sync or
+a read to make them visible to other processes reading the files.
+*/
+func (l *Log) Flush() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	return l.activeSegment.store.Flush()
+}
+
+/*
+Roll seals the active segment and starts a new one, say to bound how long records sit in a segment that's slow to fill.
+An empty active segment is left as is.
+*/
+func (l *Log) Roll() error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return nil
+	}
+	return l.roll(RollManual)
+}
+
+/*
+roll replaces the active segment with a new one starting at its next offset and reports it to Config.OnRoll. Callers
+must hold the write lock, which roll gives up but for wmu while it seals the old segment and creates the new one, so
+reads, which lock nothing else, aren't held up.
+*/
+func (l *Log) roll(reason string) error {
+	old := l.activeSegment
+	l.mu.Unlock()
+	s, err := l.seal(old)
+	l.mu.Lock()
+	if err != nil {
+		return err
+	}
+	if l.Config.Store.MaxSyncDelay > 0 {
+		// seal synced what was unsynced
+		l.unsyncedSince = time.Time{}
+	}
+	l.addSegment(s)
+	if err := l.saveManifest(); err != nil {
+		return err
+	}
+	if l.Config.OnRoll != nil {
+		l.Config.OnRoll(l.offset(old.baseOffset), l.offset(l.activeSegment.baseOffset), reason)
+	}
+	return nil
+}
+
+/*
+seal syncs and trims the old active segment as configured and creates the segment after it.
+*/
+func (l *Log) seal(old *segment) (*segment, error) {
+	policy := l.Config.Store.SyncPolicy
+	if policy == SyncOnRoll || policy == SyncInterval || l.Config.Store.MaxSyncDelay > 0 {
+		if err := old.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if l.Config.Segment.TrimOnSeal {
+		if err := old.store.trim(); err != nil {
+			return nil, err
+		}
+	}
+	return newSegment(l.Dir, old.nextOffset, l.Config)
+}
+
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+/*
+ReadContext reads the record at the given offset like Read. When Config.MaxConcurrentReads is set it first waits for
+a free read slot, giving up with ctx's error if ctx is done first.
+*/
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	if l.readSlots != nil {
+		select {
+		case l.readSlots <- struct{}{}:
+			defer func() { <-l.readSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 	// look into making locks per segment?
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	s, local, err := l.segment(off)
+	if err != nil {
+		return nil, err
+	}
+	record, err := s.Read(local)
+	if err != nil {
+		return nil, err
+	}
+	record.Offset = off
+	atomic.AddUint64(&l.reads, 1)
+	return record, nil
+}
+
+/*
+ReadWithPosition reads the record at the given offset like Read and also returns where it physically lives: its
+position in the store of the segment with the returned base offset.
+*/
+func (l *Log) ReadWithPosition(off uint64) (record *api.Record, pos uint64, segmentBase uint64, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, 0, 0, ErrLogClosed
+	}
+	s, local, err := l.segment(off)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if pos, err = s.position(local); err != nil {
+		return nil, 0, 0, err
+	}
+	if record, err = s.readAt(pos); err != nil {
+		return nil, 0, 0, s.corrupted(local, err)
+	}
+	record.Offset = off
+	atomic.AddUint64(&l.reads, 1)
+	return record, pos, s.baseOffset, nil
+}
+
+/*
+ReadMany reads the records at the given offsets, returning them in the same order. Offsets that aren't in the log get
+a nil record. The read lock is taken once, and offsets are grouped by segment and read in store order so a batch of
+random offsets touches each store sequentially.
+*/
+func (l *Log) ReadMany(offsets []uint64) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	type read struct {
+		i          int
+		local, pos uint64
+	}
+	bySegment := make(map[*segment][]read)
+	for i, off := range offsets {
+		s, local, err := l.segment(off)
+		if err != nil {
+			continue
+		}
+		pos, err := s.position(local)
+		if err == ErrRecordDeleted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bySegment[s] = append(bySegment[s], read{i, local, pos})
+	}
+	records := make([]*api.Record, len(offsets))
+	for s, reads := range bySegment {
+		sort.Slice(reads, func(i, j int) bool {
+			return reads[i].pos < reads[j].pos
+		})
+		for _, r := range reads {
+			record, err := s.readAt(r.pos)
+			if err != nil {
+				return nil, s.corrupted(r.local, err)
+			}
+			record.Offset = offsets[r.i]
+			records[r.i] = record
+		}
+		atomic.AddUint64(&l.reads, uint64(len(reads)))
+	}
+	return records, nil
+}
+
+/*
+ReadUpToBytes reads consecutive records from start until adding another would take their marshaled size past
+maxBytes, returning them with the offset to continue from. The first record is always returned, however big, so
+callers make progress. Deleted records are skipped and reading from the head of the log returns no records.
+*/
+func (l *Log) ReadUpToBytes(start uint64, maxBytes int) ([]*api.Record, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, 0, ErrLogClosed
+	}
+	next, ok := l.local(start)
+	if !ok {
+		return nil, 0, api.ErrOffsetOutOfRange{Offset: start}
+	}
+	if watermark := l.segments[0].baseOffset; next < watermark {
+		return nil, 0, api.ErrOffsetBelowWatermark{Offset: start, Watermark: l.offset(watermark)}
+	}
+	var records []*api.Record
+	var size int
+	defer func() {
+		atomic.AddUint64(&l.reads, uint64(len(records)))
+	}()
+	for _, s := range l.segments {
+		for ; s.baseOffset <= next && next < s.nextOffset; next++ {
+			record, err := s.Read(next)
+			if err == ErrRecordDeleted {
+				continue
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			n := proto.Size(record)
+			if len(records) > 0 && size+n > maxBytes {
+				return records, l.offset(next), nil
+			}
+			record.Offset = l.offset(next)
+			records = append(records, record)
+			size += n
+		}
+	}
+	return records, l.offset(next), nil
+}
+
+/*
+ReadHeaders returns the headers of the record at the given offset without decoding its value.
+*/
+func (l *Log) ReadHeaders(off uint64) (map[string][]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	s, local, err := l.segment(off)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadHeaders(local)
+}
+
+/*
+DumpIndex returns every segment's index entries keyed by the segment's base offset. It's meant for diagnostic tools
+printing the offset to position map.
+*/
+func (l *Log) DumpIndex() (map[uint64][]IndexEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	dump := make(map[uint64][]IndexEntry, len(l.segments))
+	for _, s := range l.segments {
+		entries, err := s.IndexEntries()
+		if err != nil {
+			return nil, err
+		}
+		dump[s.baseOffset] = entries
+	}
+	return dump, nil
+}
+
+/*
+segment returns the segment holding the given offset along with its local offset. Callers must hold the lock.
+*/
+func (l *Log) segment(off uint64) (*segment, uint64, error) {
+	local, ok := l.local(off)
+	if !ok {
+		return nil, 0, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if watermark := l.segments[0].baseOffset; local < watermark {
+		return nil, 0, api.ErrOffsetBelowWatermark{Offset: off, Watermark: l.offset(watermark)}
+	}
+	// the last segment whose base offset is at or below local; it's the one if local is below its next offset, as it
+	// might not be where truncation left a gap
+	i := sort.Search(len(l.bases), func(i int) bool {
+		return l.bases[i] > local
+	}) - 1
+	if s := l.segments[i]; local < s.nextOffset {
+		return s, local, nil
+	}
+	return nil, 0, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+/*
+addSegment makes s the active segment, after the others. Callers must hold the write lock.
+*/
+func (l *Log) addSegment(s *segment) {
+	if pool, ok := l.Config.fs.(*filePool); ok {
+		if l.activeSegment != nil {
+			pool.pin(l.activeSegment.store.File, false)
 		}
+		pool.pin(s.store.File, true)
+	}
+	l.segments = append(l.segments, s)
+	l.bases = append(l.bases, s.baseOffset)
+	l.activeSegment = s
+}
+
+/*
+setSegments replaces the log's segments, rebuilding the base offsets segment searches. Callers must hold the write
+lock.
+*/
+func (l *Log) setSegments(segments []*segment) {
+	l.segments = segments
+	l.bases = make([]uint64, len(segments))
+	for i, s := range segments {
+		l.bases[i] = s.baseOffset
+	}
+}
+
+/*
+offset returns the offset callers see for the given local offset, which is what segments store.
+*/
+func (l *Log) offset(local uint64) uint64 {
+	return l.Config.offset(local)
+}
+
+func (l *Log) local(off uint64) (uint64, bool) {
+	if l.Config.OffsetAllocator == nil {
+		return off, true
+	}
+	return l.Config.OffsetAllocator.Local(off)
+}
+
+/*
+ReadRelative reads a record relative to the tail of the log when n is negative: -1 is the latest record, -2 the one
+before it and so on. Going back further than the log's history clamps to the lowest offset. A non-negative n is read
+as an absolute offset.
+*/
+func (l *Log) ReadRelative(n int) (*api.Record, error) {
+	if n >= 0 {
+		return l.Read(uint64(n))
+	}
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := l.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	// count back in local offsets, which are contiguous
+	lowest, _ = l.local(lowest)
+	highest, _ = l.local(highest)
+	back := uint64(-n) - 1
+	off := lowest
+	if highest-lowest > back {
+		off = highest - back
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, fmt.Errorf("offset out of range: %d", off)
+	return l.Read(l.offset(off))
+}
+
+/*
+WaitForOffset blocks until the log holds the given offset or ctx is done. On a follower this means replication has
+caught up to a record produced on the leader, which gives clients read-your-writes across the cluster.
+*/
+func (l *Log) WaitForOffset(ctx context.Context, off uint64) error {
+	for {
+		local, ok := l.local(off)
+		if !ok {
+			return api.ErrOffsetOutOfRange{Offset: off}
+		}
+		l.mu.RLock()
+		closed := l.closed
+		next := l.segments[len(l.segments)-1].nextOffset
+		appended := l.appended
+		l.mu.RUnlock()
+		if closed {
+			return ErrLogClosed
+		}
+		if next > local {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return s.Read(off)
 }
 
+/*
+Close appends what's still queued by AppendAsync, stops the log's background work, ends its subscriptions and closes
+its segments. Everything that touches the segments' files fails with ErrLogClosed after that, waiting callers
+included, and closing it again does nothing. What's answered from memory, like Stats, TotalRecords, LowWatermark,
+Epoch and IdleDuration, still works.
+*/
 func (l *Log) Close() error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.asyncMu.Lock()
+	defer l.asyncMu.Unlock()
+	l.stopAsync()
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	defer l.unlockDir()
+	// wake WaitForOffset and blocked consumers so they see the log's closed
+	close(l.appended)
+	l.appended = make(chan struct{})
+	if l.stopSync != nil {
+		close(l.stopSync)
+		l.stopSync = nil
+	}
+	if l.stopSyncDelay != nil {
+		close(l.stopSyncDelay)
+		l.stopSyncDelay = nil
+	}
+	if l.stopCompress != nil {
+		close(l.stopCompress)
+		l.stopCompress = nil
+	}
+	for len(l.subs) > 0 {
+		l.unsubscribe(l.subs[0])
+	}
+	if err := l.saveManifest(); err != nil {
+		return err
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	err := l.compressErr
+	l.compressErr = nil
+	return err
 }
 
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	return l.Config.fileSystem().RemoveAll(l.Dir)
 }
 
 func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	l.lock()
+	defer l.unlock()
+	l.setSegments(nil)
+	l.closed = false
+	if err := l.setup(); err != nil {
+		return err
+	}
+	l.startBackground()
+	return nil
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	return l.offset(l.segments[0].baseOffset), nil
+}
+
+/*
+LowWatermark returns the lowest offset that survived truncation. Reads below it fail with
+api.ErrOffsetBelowWatermark so consumers can tell truncated offsets apart from ones past the head of the log.
+*/
+func (l *Log) LowWatermark() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.offset(l.segments[0].baseOffset)
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
-		return 0, nil
+		return l.offset(0), nil
+	}
+	return l.offset(off - 1), nil
+}
+
+/*
+Exists reports whether the log holds a record at the given offset: one between the lowest and highest offsets that
+hasn't been deleted or compacted away. Only the index is consulted, the record itself isn't read.
+*/
+func (l *Log) Exists(off uint64) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return false, ErrLogClosed
 	}
-	return off - 1, nil
+	s, local, err := l.segment(off)
+	if err != nil {
+		// out of range or below the watermark
+		return false, nil
+	}
+	return s.Exists(local)
 }
 
+/*
+Truncate removes the segments whose highest offset is lower than lowest. Their files are renamed with a deleted suffix
+rather than unlinked, see PurgeDeleted. Truncating past the end leaves an empty segment where the log left off.
+*/
 func (l *Log) Truncate(lowest uint64) error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	local, ok := l.local(lowest)
+	if !ok {
+		return api.ErrOffsetOutOfRange{Offset: lowest}
+	}
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+		if s.nextOffset <= local+1 {
+			if err := s.SoftRemove(); err != nil {
 				return err
 			}
 			continue
 		}
 		segments = append(segments, s)
 	}
-	l.segments = segments
+	next := l.activeSegment.nextOffset
+	l.setSegments(segments)
+	if len(segments) == 0 {
+		// truncating past the end removed the active segment too, so start an empty one where it left off
+		l.activeSegment = nil
+		if err := l.newSegment(next); err != nil {
+			return err
+		}
+	}
+	l.recount()
+	return l.saveManifest()
+}
+
+/*
+Delete tombstones the record at the given offset. Its bytes are reclaimed when Compact defragments its segment.
+*/
+func (l *Log) Delete(off uint64) error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	s, local, err := l.segment(off)
+	if err != nil {
+		return err
+	}
+	if err = s.Delete(local); err != nil {
+		return err
+	}
+	return l.saveManifest()
+}
+
+/*
+Redact replaces the records at the given offsets with ones holding replacement as their value, or zeros if it's nil,
+for erasing personal data. Reads of redacted offsets return the replacement under the record's original offset and
+timestamp. The affected segments are rewritten, which also drops their deleted records. Offsets that aren't in the
+log are ignored.
+*/
+func (l *Log) Redact(offsets []uint64, replacement []byte) error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	bySegment := make(map[*segment]map[uint32]bool)
+	for _, off := range offsets {
+		s, local, err := l.segment(off)
+		if err != nil {
+			continue
+		}
+		if bySegment[s] == nil {
+			bySegment[s] = make(map[uint32]bool)
+		}
+		bySegment[s][uint32(local-s.baseOffset)] = true
+	}
+	for s, rels := range bySegment {
+		if err := s.Redact(rels, replacement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Compact defragments the segments whose dirty ratio is above Config.CompactDirtyRatio, and splits sealed segments
+over Config.Segment.MaxStoreBytes after ApplyConfig lowered it. It's meant to be called periodically alongside
+Truncate by whatever enforces retention.
+*/
+func (l *Log) Compact() error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if l.resplit {
+		if err := l.splitOversized(); err != nil {
+			return err
+		}
+		l.resplit = false
+	}
+	if l.Config.CompactDirtyRatio <= 0 {
+		return nil
+	}
+	for _, s := range l.segments {
+		if s.DirtyRatio() <= l.Config.CompactDirtyRatio {
+			continue
+		}
+		if err := s.Defragment(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+CompressSealed compresses every sealed segment that isn't compressed yet, see segment.Compress. The lock is held for
+one segment at a time so appends can carry on in between.
+*/
+func (l *Log) CompressSealed() error {
+	return l.compressSealed(nil)
+}
+
+/*
+compressSealed is CompressSealed, giving up quietly once stop is closed.
+*/
+func (l *Log) compressSealed(stop chan struct{}) error {
+	for {
+		l.lock()
+		select {
+		case <-stop:
+			l.unlock()
+			return nil
+		default:
+		}
+		if l.closed {
+			l.unlock()
+			return ErrLogClosed
+		}
+		var next *segment
+		for _, s := range l.segments {
+			if s != l.activeSegment && !s.Compressed() {
+				next = s
+				break
+			}
+		}
+		if next == nil {
+			l.unlock()
+			return nil
+		}
+		err := next.Compress()
+		l.unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+compressEvery compresses sealed segments every d until stop is closed. Failures are returned by Close.
+*/
+func (l *Log) compressEvery(d time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := l.compressSealed(stop); err != nil {
+			l.lock()
+			l.compressErr = err
+			l.unlock()
+		}
+	}
+}
+
+/*
+PurgeDeleted unlinks the files of segments removed by Truncate more than olderThan ago. Until then they can be
+recovered by hand by dropping their deleted suffix.
+*/
+func (l *Log) PurgeDeleted(olderThan time.Duration) error {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	files, err := l.Config.fileSystem().ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	cutoff := l.Config.clock().Now().Add(-olderThan)
+	for _, file := range files {
+		if path.Ext(file.Name()) != deletedSuffix || file.ModTime().After(cutoff) {
+			continue
+		}
+		if err = l.Config.fileSystem().Remove(path.Join(l.Dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Checksum hashes the log's records in offset order so two copies of a log can be compared, say after shipping one to a
+remote. Only the records go into the hash, not the store framing or headers, so it doesn't depend on how the log is
+split into segments, its format version or encryption. Deleted records are skipped.
+*/
+func (l *Log) Checksum() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	h := fnv.New64a()
+	size := make([]byte, lenWidth)
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			pos, err := s.position(off)
+			if err == ErrRecordDeleted {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			p, err := s.store.Read(pos)
+			if err != nil {
+				return 0, err
+			}
+			// hashing the length keeps records' boundaries from being ambiguous
+			enc.PutUint64(size, uint64(len(p)))
+			h.Write(size)
+			h.Write(p)
+		}
+	}
+	return h.Sum64(), nil
+}
+
+/*
+Copy clones the log into dir and returns a new Log opened on the copy. The read lock is held for the whole copy so the
+segment set is snapshotted and appends can't leave a half-copied active segment.
+*/
+func (l *Log) Copy(dir string) (*Log, error) {
+	if err := l.copyTo(dir); err != nil {
+		return nil, err
+	}
+	return NewLog(dir, l.Config)
+}
+
+func (l *Log) copyTo(dir string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if err := l.Config.fileSystem().MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if err := s.Copy(dir); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.closed {
+		return errReader{ErrLogClosed}
+	}
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
 		readers[i] = &originReader{segment.store, 0}
@@ -171,6 +1264,15 @@ func (l *Log) Reader() io.Reader {
 	return io.MultiReader(readers...)
 }
 
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
 type originReader struct {
 	*store
 	off int64
@@ -182,12 +1284,36 @@ func (o *originReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+/*
+openKnownSegment opens a sealed segment from its manifest entry and adds it to the log.
+*/
+func (l *Log) openKnownSegment(e manifestEntry) error {
+	s, err := openSegment(l.Dir, e.baseOffset, l.Config, &e)
+	if err != nil {
+		return err
+	}
+	l.addSegment(s)
+	return nil
+}
+
+/*
+lock takes the write lock, excluding both readers and the other writers.
+*/
+func (l *Log) lock() {
+	l.wmu.Lock()
+	l.mu.Lock()
+}
+
+func (l *Log) unlock() {
+	l.mu.Unlock()
+	l.wmu.Unlock()
+}
+
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
-	l.segments = append(l.segments, s)
-	l.activeSegment = s
+	l.addSegment(s)
 	return nil
 }
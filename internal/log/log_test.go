@@ -0,0 +1,1972 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLogCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-copy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(l.segments) > 1)
+
+	dst, err := ioutil.TempDir("", "log-copy-test-dst")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	cp, err := l.Copy(dst)
+	require.NoError(t, err)
+	require.Equal(t, len(l.segments), len(cp.segments))
+
+	lowest, err := cp.LowestOffset()
+	require.NoError(t, err)
+	highest, err := cp.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(9), highest)
+	for off := lowest; off <= highest; off++ {
+		want, err := l.Read(off)
+		require.NoError(t, err)
+		got, err := cp.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Offset, got.Offset)
+	}
+
+	// the copy is independent of the original
+	off, err := cp.Append(&api.Record{Value: []byte("copy only")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	_, err = l.Read(off)
+	require.Error(t, err)
+	require.NoError(t, cp.Close())
+	require.NoError(t, l.Close())
+}
+
+func TestLogMixedFormatVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-mixed-format-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("v1")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// the empty active segment picks up the new version, the full ones stay v1
+	c.Store.FormatVersion = FormatV2
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("v2")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, FormatV1, l.segments[0].store.version)
+	require.Equal(t, FormatV2, l.segments[len(l.segments)-1].store.version)
+	require.NoError(t, l.Close())
+
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 12; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		want := "v1"
+		if off >= 6 {
+			want = "v2"
+		}
+		require.Equal(t, want, string(record.Value))
+	}
+	require.NoError(t, l.Close())
+}
+
+func TestLogSubscriberStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-subscriber-stats-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	fast, err := l.Subscribe(10)
+	require.NoError(t, err)
+	// slow never reads, so its buffer fills up and later records get dropped
+	slow, err := l.Subscribe(2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		<-fast.C
+	}
+
+	stats := l.SubscriberStats()
+	require.Equal(t, []SubscriberStat{
+		{ID: fast.id, Buffered: 0, Dropped: 0, HighWater: 1},
+		{ID: slow.id, Buffered: 2, Dropped: 3, HighWater: 2},
+	}, stats)
+
+	record := <-slow.C
+	require.Equal(t, uint64(0), record.Offset)
+	require.Equal(t, 1, l.SubscriberStats()[1].Buffered)
+
+	slow.Close()
+	require.Len(t, l.SubscriberStats(), 1)
+}
+
+func TestLogSubscribeCopiesRecords(t *testing.T) {
+	l, err := NewMemLog(Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	a, err := l.Subscribe(1)
+	require.NoError(t, err)
+	b, err := l.Subscribe(1)
+	require.NoError(t, err)
+
+	// the producer reusing its record doesn't change what subscribers got
+	record := &api.Record{Value: []byte("hello world")}
+	_, err = l.Append(record)
+	require.NoError(t, err)
+	record.Value[0] = 'j'
+	record.Offset = 7
+	got := <-a.C
+	require.Equal(t, "hello world", string(got.Value))
+	require.Equal(t, uint64(0), got.Offset)
+	// which is one copy shared by every subscription
+	require.True(t, got == <-b.C)
+}
+
+func TestLogSubscribeSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-subscribe-since-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	c := Config{}
+	c.Clock = clock
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendAt := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			clock.now = clock.now.Add(time.Second)
+		}
+	}
+	appendAt(5)
+	require.NoError(t, l.Delete(3))
+
+	// offsets 2 to 4 are history, minus the deleted one, and 5 and 6 are appended while replaying
+	sub, err := l.SubscribeSince(time.Date(2021, 6, 1, 0, 0, 2, 0, time.UTC), 10)
+	require.NoError(t, err)
+	record := <-sub.C
+	require.Equal(t, uint64(2), record.Offset)
+	appendAt(2)
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		offsets = append(offsets, (<-sub.C).Offset)
+	}
+	require.Equal(t, []uint64{4, 5, 6}, offsets)
+	appendAt(1)
+	require.Equal(t, uint64(7), (<-sub.C).Offset)
+
+	// with nothing since, only new records arrive
+	future, err := l.SubscribeSince(clock.now.Add(time.Hour), 10)
+	require.NoError(t, err)
+	appendAt(1)
+	require.Equal(t, uint64(8), (<-future.C).Offset)
+	require.Equal(t, uint64(8), (<-sub.C).Offset)
+
+	sub.Close()
+	_, ok := <-sub.C
+	require.False(t, ok)
+}
+
+func TestLogOnCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-on-corruption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	type corruption struct {
+		segmentBase, offset uint64
+		err                 error
+	}
+	var reported []corruption
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Store.FormatVersion = FormatV2
+	c.OnCorruption = func(segmentBase, offset uint64, err error) {
+		reported = append(reported, corruption{segmentBase, offset, err})
+	}
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, pos, base, err := l.ReadWithPosition(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), base)
+	corrupt, err := os.OpenFile(path.Join(dir, "3.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = corrupt.WriteAt([]byte("J"), int64(pos+lenWidth+crcWidth))
+	require.NoError(t, err)
+	require.NoError(t, corrupt.Close())
+
+	_, err = l.Read(4)
+	require.Equal(t, ErrChecksumMismatch, err)
+	_, err = l.ReadMany([]uint64{0, 4})
+	require.Equal(t, ErrChecksumMismatch, err)
+	require.Equal(t, []corruption{{3, 4, ErrChecksumMismatch}, {3, 4, ErrChecksumMismatch}}, reported)
+
+	// errors that aren't corruption aren't reported
+	_, err = l.Read(5)
+	require.Error(t, err)
+	_, err = l.Read(3)
+	require.NoError(t, err)
+	require.Len(t, reported, 2)
+}
+
+func TestLogReadRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-relative-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+
+	for n, want := range map[int]uint64{
+		-1:    7,
+		-5:    3,
+		-1000: 0,
+		2:     2,
+	} {
+		record, err := l.ReadRelative(n)
+		require.NoError(t, err)
+		require.Equal(t, want, record.Offset, n)
+	}
+
+	// clamping follows the lowest offset after a truncation
+	require.NoError(t, l.Truncate(2))
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	record, err := l.ReadRelative(-1000)
+	require.NoError(t, err)
+	require.Equal(t, lowest, record.Offset)
+}
+
+func TestLogOutOfOrderWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-out-of-order-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.MonotonicTimestamps = true
+	c.OutOfOrderWindow = time.Second
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+
+	base := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *api.Record {
+		return &api.Record{Value: []byte("hello world"), Timestamp: base.Add(d).UnixNano()}
+	}
+
+	off, err := l.Append(at(10 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	// inside the window of the last record
+	off, err = l.Append(at(9500 * time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	// older than the window allows
+	_, err = l.Append(at(8 * time.Second))
+	require.Equal(t, ErrTooLate, err)
+	off, err = l.Append(at(11 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, l.Close())
+
+	// the last timestamp survives a reopen
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	_, err = l.Append(at(9 * time.Second))
+	require.Equal(t, ErrTooLate, err)
+	off, err = l.Append(at(10500 * time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// a chain of records each inside the window of the one before doesn't drag the window back with it
+	off, err = l.Append(at(10100 * time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = l.Append(at(9900 * time.Millisecond))
+	require.Equal(t, ErrTooLate, err)
+	require.NoError(t, l.Close())
+
+	// nor does reopening after one
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Append(at(9900 * time.Millisecond))
+	require.Equal(t, ErrTooLate, err)
+}
+
+func TestLogWaitForOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-wait-for-offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	follower, err := newTestLog(dir, Config{})
+	require.NoError(t, err)
+	defer follower.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, follower.WaitForOffset(ctx, 0))
+
+	// stands in for the replicator delivering records produced on the leader
+	replicated := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			if _, err := follower.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				replicated <- err
+				return
+			}
+		}
+		replicated <- nil
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, follower.WaitForOffset(ctx, 2))
+	require.NoError(t, <-replicated)
+	record, err := follower.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	// offsets the log already holds return straight away
+	require.NoError(t, follower.WaitForOffset(ctx, 0))
+}
+
+func TestLogHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-headers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	headers := map[string][]byte{
+		"trace-id": []byte("abc123"),
+		"source":   []byte("ingest"),
+		"empty":    {},
+	}
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	off, err := l.Append(&api.Record{Value: []byte("hello world"), Headers: headers})
+	require.NoError(t, err)
+
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, len(headers), len(record.Headers))
+	for k, v := range headers {
+		require.Equal(t, string(v), string(record.Headers[k]))
+	}
+	got, err := l.ReadHeaders(off)
+	require.NoError(t, err)
+	require.Equal(t, len(headers), len(got))
+	for k, v := range headers {
+		require.Equal(t, string(v), string(got[k]))
+	}
+
+	got, err = l.ReadHeaders(0)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	_, err = l.ReadHeaders(off + 1)
+	require.Error(t, err)
+}
+
+func TestLogLowWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-low-watermark-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(0), l.LowWatermark())
+
+	require.NoError(t, l.Truncate(4))
+	require.Equal(t, uint64(3), l.LowWatermark())
+
+	_, err = l.Read(1)
+	require.Equal(t, api.ErrOffsetBelowWatermark{Offset: 1, Watermark: 3}, err)
+	require.Contains(t, err.Error(), "3")
+	_, err = l.Read(8)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 8}, err)
+	record, err := l.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+}
+
+func TestLogTotalPayloadBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-payload-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	var want uint64
+	for i := 0; i < 8; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record-%d", i))}
+		_, err := l.Append(record)
+		require.NoError(t, err)
+		want += uint64(proto.Size(record))
+	}
+	require.Equal(t, want, l.TotalPayloadBytes())
+	require.NoError(t, l.Close())
+
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, want, l.TotalPayloadBytes())
+}
+
+func TestLogOpenFileCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-open-file-count-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 2)
+	c.Manifest = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// the active segment's store and index and the directory's lock
+	require.Equal(t, 3, l.OpenFileCount())
+	appendRolls(t, l, 10)
+	requireSegments(t, l, 6)
+	require.Equal(t, 13, l.OpenFileCount())
+	require.NoError(t, l.Close())
+	require.Equal(t, 0, l.OpenFileCount())
+
+	m, err := NewMemLog(c)
+	require.NoError(t, err)
+	defer m.Close()
+	appendRolls(t, m, 10)
+	require.Equal(t, 0, m.OpenFileCount())
+}
+
+func TestLogTotalRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-total-records-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(0), l.TotalRecords())
+	for i := 0; i < 2; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(2), l.TotalRecords())
+
+	// rolling doesn't change the count, and the new segment's records add to it
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	requireSegments(t, l, 3)
+	require.Equal(t, uint64(7), l.TotalRecords())
+	require.Equal(t, l.Stats().Records, l.TotalRecords())
+
+	// truncating drops the first segment's records, deleting one doesn't
+	require.NoError(t, l.Truncate(2))
+	require.NoError(t, l.Delete(4))
+	require.Equal(t, uint64(4), l.TotalRecords())
+	require.NoError(t, l.Close())
+
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(4), l.TotalRecords())
+}
+
+func TestLogReadMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-many-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+
+	offsets := []uint64{7, 0, 100, 4, 5, 0, 3}
+	records, err := l.ReadMany(offsets)
+	require.NoError(t, err)
+	require.Len(t, records, len(offsets))
+	for i, off := range offsets {
+		if off >= 8 {
+			require.Nil(t, records[i])
+			continue
+		}
+		require.Equal(t, off, records[i].Offset)
+		require.Equal(t, fmt.Sprintf("record-%d", off), string(records[i].Value))
+	}
+}
+
+func benchmarkLog(b *testing.B, records int) *Log {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "log-bench")
+	require.NoError(b, err)
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 100
+	c.Segment.MaxStoreBytes = 1 << 20
+	l, err := NewLog(dir, c)
+	require.NoError(b, err)
+	b.Cleanup(func() { l.Close() })
+	for i := 0; i < records; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	return l
+}
+
+func benchmarkOffsets(n, max int) []uint64 {
+	offsets := make([]uint64, n)
+	for i := range offsets {
+		offsets[i] = uint64((i * 7919) % max)
+	}
+	return offsets
+}
+
+func BenchmarkLogReadLoop(b *testing.B) {
+	l := benchmarkLog(b, 1000)
+	offsets := benchmarkOffsets(100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, off := range offsets {
+			if _, err := l.Read(off); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLogReadMany(b *testing.B) {
+	l := benchmarkLog(b, 1000)
+	offsets := benchmarkOffsets(100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.ReadMany(offsets); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+/*
+BenchmarkLogReadDuringRolls reads sealed segments while another goroutine appends to a log that rolls every ten
+records and syncs on every roll.
+*/
+func BenchmarkLogReadDuringRolls(b *testing.B) {
+	dir, err := ioutil.TempDir("", "log-bench-rolls")
+	require.NoError(b, err)
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 10
+	c.Store.SyncPolicy = SyncOnRoll
+	l, err := NewLog(dir, c)
+	require.NoError(b, err)
+	for i := 0; i < 1000; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := l.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		l.Close()
+	}()
+	offsets := benchmarkOffsets(100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Read(offsets[i%len(offsets)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+/*
+BenchmarkLogReadRouting reads records scattered over a thousand segments, which finding each one's segment dominates.
+*/
+func BenchmarkLogReadRouting(b *testing.B) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	l, err := NewMemLog(c)
+	require.NoError(b, err)
+	b.Cleanup(func() { l.Close() })
+	for i := 0; i < 1000; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	requireSegments(b, l, 1001)
+	offsets := benchmarkOffsets(100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Read(offsets[i%len(offsets)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLogSegmentRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-segment-routing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 2)
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 10)
+	requireSegments(t, l, 6)
+	requireRouting := func(lowest uint64) {
+		t.Helper()
+		bases := make([]uint64, len(l.segments))
+		for i, s := range l.segments {
+			bases[i] = s.baseOffset
+		}
+		require.Equal(t, bases, l.bases)
+		for off := uint64(0); off < lowest; off++ {
+			_, err := l.Read(off)
+			require.Equal(t, api.ErrOffsetBelowWatermark{Offset: off, Watermark: lowest}, err)
+		}
+		requireMemRecords(t, l, lowest, rollOffset+9)
+	}
+	requireRouting(rollOffset)
+
+	// truncation leaves segments starting above where the log began
+	require.NoError(t, l.Truncate(rollOffset+3))
+	requireSegments(t, l, 4)
+	requireRouting(rollOffset + 4)
+
+	require.NoError(t, l.Coalesce([]uint64{rollOffset + 4, rollOffset + 6}, c.Segment.MaxStoreBytes*2))
+	requireSegments(t, l, 3)
+	requireRouting(rollOffset + 4)
+
+	appendRolls(t, l, 2)
+	requireSegments(t, l, 4)
+	requireMemRecords(t, l, rollOffset+4, rollOffset+11)
+}
+
+func TestLogReadDuringRoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-during-roll-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Store.SyncPolicy = SyncOnRoll
+	syncing, release := make(chan struct{}), make(chan struct{})
+	var block bool
+	c.Store.Syncer = func(f *os.File) error {
+		if block {
+			block = false
+			close(syncing)
+			<-release
+		}
+		return f.Sync()
+	}
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// the fourth append rolls and blocks syncing the sealed segment
+	block = true
+	appended := make(chan error)
+	go func() {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		appended <- err
+	}()
+	<-syncing
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	_, err = l.Read(3)
+	require.NoError(t, err)
+	close(release)
+	require.NoError(t, <-appended)
+	requireSegments(t, l, 3)
+}
+
+func TestLogSyncOnRoll(t *testing.T) {
+	for name, policy := range map[string]SyncPolicy{"sync": SyncOnRoll, "no sync": SyncNone} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-sync-on-roll-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			c.Store.SyncPolicy = policy
+			l, err := newTestLog(dir, c)
+			require.NoError(t, err)
+			defer l.Close()
+			for i := 0; i < 4; i++ {
+				_, err := l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			requireSegments(t, l, 2)
+
+			// simulate a crash by opening the directory again without closing the log, whose lock would have gone
+			// with the crashed process
+			require.NoError(t, l.unlockDir())
+			crashed, err := newTestLog(dir, c)
+			require.NoError(t, err)
+			defer crashed.Close()
+			for off := uint64(0); off < 3; off++ {
+				record, err := crashed.Read(off)
+				if policy == SyncNone {
+					// the sealed segment's records were still sitting in the store's buffer
+					require.Error(t, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+			}
+		})
+	}
+}
+
+func TestLogMaxSyncDelay(t *testing.T) {
+	newLog := func(t *testing.T, c Config, syncs *int32) *Log {
+		dir, err := ioutil.TempDir("", "log-max-sync-delay-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c.Store.Syncer = func(f *os.File) error {
+			atomic.AddInt32(syncs, 1)
+			return f.Sync()
+		}
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+
+	t.Run("fake clock", func(t *testing.T) {
+		var syncs int32
+		clock := &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+		c := Config{}
+		c.Clock = clock
+		// long enough that the background sync never wakes during the test, which drives syncDue itself
+		c.Store.MaxSyncDelay = time.Hour
+		l := newLog(t, c, &syncs)
+		syncDue := func() time.Duration {
+			l.lock()
+			defer l.unlock()
+			left, err := l.syncDue(c.Store.MaxSyncDelay)
+			require.NoError(t, err)
+			return left
+		}
+
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		clock.now = clock.now.Add(40 * time.Minute)
+		require.Equal(t, 20*time.Minute, syncDue())
+		require.Equal(t, int32(0), atomic.LoadInt32(&syncs))
+		// a later append doesn't push the deadline back
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		clock.now = clock.now.Add(20 * time.Minute)
+		require.Equal(t, time.Duration(0), syncDue())
+		require.Equal(t, int32(1), atomic.LoadInt32(&syncs))
+		// nothing's left unsynced
+		clock.now = clock.now.Add(2 * time.Hour)
+		require.Equal(t, time.Duration(0), syncDue())
+		require.Equal(t, int32(1), atomic.LoadInt32(&syncs))
+	})
+
+	t.Run("background", func(t *testing.T) {
+		var syncs int32
+		c := Config{}
+		c.Store.MaxSyncDelay = 5 * time.Millisecond
+		l := newLog(t, c, &syncs)
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&syncs) == 1
+		}, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		require.Equal(t, int32(1), atomic.LoadInt32(&syncs))
+	})
+}
+
+func TestLogSyncPolicy(t *testing.T) {
+	for name, tc := range map[string]struct {
+		policy SyncPolicy
+		want   int32
+	}{
+		"none": {SyncNone, 0},
+		// the roll after the third record
+		"on roll": {SyncOnRoll, 1},
+		"always":  {SyncAlways, 4},
+	} {
+		policy, want := tc.policy, tc.want
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-sync-policy-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			var syncs int32
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			c.Store.SyncPolicy = policy
+			c.Store.Syncer = func(f *os.File) error {
+				atomic.AddInt32(&syncs, 1)
+				return f.Sync()
+			}
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 4; i++ {
+				_, err := l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, l.Close())
+			require.Equal(t, want, atomic.LoadInt32(&syncs))
+		})
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "log-sync-policy-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		var syncs int32
+		c := Config{}
+		c.Store.SyncPolicy = SyncInterval
+		c.Store.Syncer = func(f *os.File) error {
+			atomic.AddInt32(&syncs, 1)
+			return f.Sync()
+		}
+		// appends aren't synced until the interval is up
+		c.Store.SyncInterval = time.Hour
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&syncs))
+		require.NoError(t, l.Remove())
+
+		c.Store.SyncInterval = 5 * time.Millisecond
+		l, err = NewLog(dir, c)
+		require.NoError(t, err)
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&syncs) >= 2
+		}, time.Second, time.Millisecond)
+
+		// the ticker carries on after a reset
+		require.NoError(t, l.Reset())
+		reset := atomic.LoadInt32(&syncs)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&syncs) >= reset+2
+		}, time.Second, time.Millisecond)
+		require.NoError(t, l.Close())
+
+		// the ticker stops with the log
+		stopped := atomic.LoadInt32(&syncs)
+		time.Sleep(20 * time.Millisecond)
+		require.Equal(t, stopped, atomic.LoadInt32(&syncs))
+	})
+}
+
+func TestLogDumpIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-dump-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 4; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	dump, err := l.DumpIndex()
+	require.NoError(t, err)
+	require.Len(t, dump, 2)
+	require.Len(t, dump[0], 3)
+	require.Equal(t, []IndexEntry{{Off: 0, Pos: 0}}, dump[3])
+}
+
+func TestLogPurgeDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-purge-deleted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 7; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Truncate(4))
+
+	deleted := []string{"0.index.deleted", "0.store.deleted"}
+	for _, name := range deleted {
+		_, err := os.Stat(path.Join(dir, name))
+		require.NoError(t, err)
+	}
+	_, err = os.Stat(path.Join(dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+
+	// deleted files are ignored when reopening
+	require.NoError(t, l.unlockDir())
+	reopened, err := NewLog(dir, c)
+	require.NoError(t, err)
+	lowest, err := reopened.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+	require.NoError(t, reopened.Close())
+
+	// still inside the grace period
+	require.NoError(t, l.PurgeDeleted(time.Hour))
+	for _, name := range deleted {
+		_, err := os.Stat(path.Join(dir, name))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, l.PurgeDeleted(0))
+	for _, name := range deleted {
+		_, err := os.Stat(path.Join(dir, name))
+		require.True(t, os.IsNotExist(err))
+	}
+	_, err = os.Stat(path.Join(dir, "3.store"))
+	require.NoError(t, err)
+}
+
+func TestLogCleansTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-temp-files-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// an interrupted create of the first segment
+	for _, name := range []string{"0.index.tmp", "0.store.tmp"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte("partial"), 0644))
+	}
+	c := Config{}
+	c.Store.FormatVersion = FormatV2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	require.Equal(t, []string{"0.index", "0.store", lockName}, names)
+	require.Equal(t, FormatV2, l.activeSegment.store.version)
+
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestLogReadWithPosition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-with-position-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	record, pos, base, err := l.ReadWithPosition(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), record.Offset)
+	require.Equal(t, uint64(3), base)
+
+	var s *segment
+	for _, seg := range l.segments {
+		if seg.baseOffset == base {
+			s = seg
+		}
+	}
+	require.NotNil(t, s)
+	size := make([]byte, lenWidth)
+	_, err = s.store.ReadAt(size, int64(pos))
+	require.NoError(t, err)
+	p := make([]byte, enc.Uint64(size))
+	_, err = s.store.ReadAt(p, int64(pos+lenWidth))
+	require.NoError(t, err)
+	want, err := proto.Marshal(record)
+	require.NoError(t, err)
+	require.Equal(t, want, p)
+
+	_, _, _, err = l.ReadWithPosition(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+}
+
+func TestLogCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.CompactDirtyRatio = 0.5
+	// so every record's offset marshals to the same size
+	c.Segment.InitialOffset = 16
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// three quarters of the first segment and a quarter of the second
+	for _, off := range []uint64{16, 17, 18, 20} {
+		require.NoError(t, l.Delete(off))
+	}
+	// deleting twice doesn't count twice
+	require.NoError(t, l.Delete(20))
+	first, second := l.segments[0], l.segments[1]
+	require.Equal(t, 0.75, first.DirtyRatio())
+	require.Equal(t, 0.25, second.DirtyRatio())
+	firstSize, secondSize := first.store.size, second.store.size
+
+	// the dirty bytes are worked out again on reopen
+	require.NoError(t, l.unlockDir())
+	reopened, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 0.75, reopened.segments[0].DirtyRatio())
+	require.NoError(t, reopened.Close())
+
+	require.NoError(t, l.Compact())
+	require.Equal(t, firstSize/4, first.store.size)
+	require.Equal(t, float64(0), first.DirtyRatio())
+	require.Equal(t, secondSize, second.store.size)
+
+	record, err := l.Read(19)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), record.Offset)
+	_, err = l.Read(17)
+	require.Equal(t, ErrRecordDeleted, err)
+}
+
+func TestLogChecksum(t *testing.T) {
+	checksum := func(maxIndexBytes uint64, n int) uint64 {
+		dir, err := ioutil.TempDir("", "log-checksum-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		c := Config{}
+		c.Segment.MaxIndexBytes = maxIndexBytes
+		// records are stamped with the clock, so both logs need the same time
+		c.Clock = &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+		l, err := newTestLog(dir, c)
+		require.NoError(t, err)
+		defer l.Close()
+		for i := 0; i < n; i++ {
+			_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+		sum, err := l.Checksum()
+		require.NoError(t, err)
+		return sum
+	}
+	small, large := checksum(entWidth*2, 7), checksum(1024, 7)
+	require.Equal(t, small, large)
+	require.NotEqual(t, small, checksum(1024, 8))
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestLogClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-clock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	c := Config{}
+	c.Clock = clock
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	var want []int64
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		want = append(want, clock.now.UnixNano())
+		clock.now = clock.now.Add(time.Second)
+	}
+	// producers' own timestamps are kept
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: 42})
+	require.NoError(t, err)
+	want = append(want, 42)
+
+	for off, ts := range want {
+		record, err := l.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, ts, record.Timestamp)
+	}
+}
+
+// stridedAllocator interleaves the offsets of stride shards: shard s gets s, s+stride, s+2*stride...
+type stridedAllocator struct {
+	shard, stride uint64
+}
+
+func (a stridedAllocator) Offset(local uint64) uint64 {
+	return local*a.stride + a.shard
+}
+
+func (a stridedAllocator) Local(off uint64) (uint64, bool) {
+	if off%a.stride != a.shard {
+		return 0, false
+	}
+	return off / a.stride, true
+}
+
+func TestLogOffsetAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-offset-allocator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.OffsetAllocator = stridedAllocator{shard: 2, stride: 10}
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := uint64(0); i < 5; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		off, err := l.Append(record)
+		require.NoError(t, err)
+		require.Equal(t, 10*i+2, off)
+		require.Equal(t, off, record.Offset)
+	}
+	// the segments still roll on local offsets
+	requireSegments(t, l, 2)
+	requireActiveBase(t, l, 3)
+
+	for i := uint64(0); i < 5; i++ {
+		record, err := l.Read(10*i + 2)
+		require.NoError(t, err)
+		require.Equal(t, 10*i+2, record.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+	_, err = l.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+	_, err = l.Read(52)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 52}, err)
+
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), highest)
+	record, err := l.ReadRelative(-2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(32), record.Offset)
+	records, err := l.ReadMany([]uint64{42, 5, 12})
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), records[0].Offset)
+	require.Nil(t, records[1])
+	require.Equal(t, uint64(12), records[2].Offset)
+	// offsets of other shards are reported as the caller gave them
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 13}, l.Truncate(13))
+}
+
+func TestLogReadUpToBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-up-to-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.InitialOffset = 16
+	c.Clock = &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	var size int
+	for i := 0; i < 4; i++ {
+		record := &api.Record{Value: []byte("hello world")}
+		_, err := l.Append(record)
+		require.NoError(t, err)
+		size = proto.Size(record)
+	}
+	big := &api.Record{Value: make([]byte, 1024)}
+	_, err = l.Append(big)
+	require.NoError(t, err)
+
+	// exactly two records fit
+	records, next, err := l.ReadUpToBytes(16, 2*size)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(16), records[0].Offset)
+	require.Equal(t, uint64(18), next)
+	// one byte short of the third
+	records, next, err = l.ReadUpToBytes(next, 3*size-1)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(20), next)
+
+	// the large record comes back on its own despite the budget
+	records, next, err = l.ReadUpToBytes(next, size)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, big.Value, records[0].Value)
+	require.Equal(t, uint64(21), next)
+
+	records, next, err = l.ReadUpToBytes(next, size)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(21), next)
+}
+
+func TestLogReadUpToBytesPagination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-up-to-bytes-pagination-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Segment.InitialOffset = 16
+	c.Clock = &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	var size int
+	for i := 0; i < 10; i++ {
+		record := &api.Record{Value: []byte("hello world")}
+		_, err := l.Append(record)
+		require.NoError(t, err)
+		size = proto.Size(record)
+	}
+	requireSegments(t, l, 3)
+
+	// the budget runs out mid-segment
+	records, next, err := l.ReadUpToBytes(16, 3*size)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, uint64(19), next)
+
+	// and a page spans the boundary into the next segment
+	records, next, err = l.ReadUpToBytes(next, 3*size)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{19, 20, 21}, []uint64{records[0].Offset, records[1].Offset, records[2].Offset})
+	require.Equal(t, uint64(22), next)
+
+	// paging through the rest gets every record once
+	for off := next; off < 26; {
+		records, next, err = l.ReadUpToBytes(off, 3*size)
+		require.NoError(t, err)
+		require.NotEmpty(t, records)
+		for _, record := range records {
+			require.Equal(t, off, record.Offset)
+			off++
+		}
+		require.Equal(t, off, next)
+	}
+	require.Equal(t, uint64(26), next)
+}
+
+func TestLogOnRoll(t *testing.T) {
+	type roll struct {
+		oldBase, newBase uint64
+		reason           string
+	}
+	byStore := rollConfig(t, 3)
+	byIndex := rollConfig(t, 3)
+	byIndex.Segment.MaxStoreBytes = 1024
+	byIndex.Segment.MaxIndexBytes = entWidth * 3
+	for name, tc := range map[string]struct {
+		c      Config
+		reason string
+	}{
+		"store": {byStore, RollStoreMaxed},
+		"index": {byIndex, RollIndexMaxed},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-on-roll-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			var rolls []roll
+			c := tc.c
+			c.OnRoll = func(oldBase, newBase uint64, reason string) {
+				rolls = append(rolls, roll{oldBase, newBase, reason})
+			}
+			l, err := newTestLog(dir, c)
+			require.NoError(t, err)
+			defer l.Close()
+			appendRolls(t, l, 3)
+			require.Equal(t, []roll{{16, 19, tc.reason}}, rolls)
+
+			// an empty active segment isn't rolled
+			require.NoError(t, l.Roll())
+			appendRolls(t, l, 1)
+			require.NoError(t, l.Roll())
+			require.Equal(t, []roll{{16, 19, tc.reason}, {19, 20, RollManual}}, rolls)
+			requireSegments(t, l, 3)
+			requireActiveBase(t, l, 20)
+		})
+	}
+}
+
+// blockingIndex blocks reads on release once blocking is set
+type blockingIndex struct {
+	Index
+	blocking int32
+	entered  chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingIndex) Read(in int64) (uint32, uint64, error) {
+	if atomic.LoadInt32(&b.blocking) == 1 {
+		b.entered <- struct{}{}
+		<-b.release
+	}
+	return b.Index.Read(in)
+}
+
+func TestLogMaxConcurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-concurrent-reads-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	idx := &blockingIndex{entered: make(chan struct{}), release: make(chan struct{})}
+	c := Config{}
+	c.MaxConcurrentReads = 1
+	c.Segment.NewIndex = func(f *os.File, c Config) (Index, error) {
+		var err error
+		idx.Index, err = newIndex(f, c)
+		return idx, err
+	}
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&idx.blocking, 1)
+	first := make(chan error)
+	go func() {
+		_, err := l.Read(0)
+		first <- err
+	}()
+	<-idx.entered
+	atomic.StoreInt32(&idx.blocking, 0)
+
+	// the first read holds the only slot
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = l.ReadContext(ctx, 0)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	close(idx.release)
+	require.NoError(t, <-first)
+	record, err := l.ReadContext(context.Background(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestLogDescribeJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-describe-json-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 7)
+	_, err = l.Read(rollOffset)
+	require.NoError(t, err)
+
+	b, err := l.DescribeJSON()
+	require.NoError(t, err)
+	var d Description
+	require.NoError(t, json.Unmarshal(b, &d))
+	require.Equal(t, dir, d.Dir)
+	require.Equal(t, uint64(7), d.Records)
+	require.Equal(t, uint64(7), d.Appends)
+	require.Equal(t, uint64(1), d.Reads)
+	require.Equal(t, l.Stats().Bytes, d.Bytes)
+
+	full := c.Segment.MaxStoreBytes
+	require.Equal(t, []SegmentDescription{
+		{BaseOffset: 16, NextOffset: 19, StoreBytes: full, IndexBytes: 3 * entWidth, FormatVersion: FormatV1, Sealed: true},
+		{BaseOffset: 19, NextOffset: 22, StoreBytes: full, IndexBytes: 3 * entWidth, FormatVersion: FormatV1, Sealed: true},
+		{BaseOffset: 22, NextOffset: 23, StoreBytes: full / 3, IndexBytes: entWidth, FormatVersion: FormatV1},
+	}, d.Segments)
+	// field names are what tools will key on
+	require.Contains(t, string(b), `"base_offset":16`)
+	require.Contains(t, string(b), `"sealed":true`)
+}
+
+func TestLogRedact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-redact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	var want []*api.Record
+	for i := 0; i < 6; i++ {
+		record := &api.Record{
+			Value:   []byte(fmt.Sprintf("personal data %d", i)),
+			Headers: map[string][]byte{"email": []byte("someone@example.com")},
+		}
+		_, err := l.Append(record)
+		require.NoError(t, err)
+		want = append(want, record)
+	}
+
+	require.NoError(t, l.Redact([]uint64{1, 4, 100}, []byte("redacted")))
+	require.NoError(t, l.Redact([]uint64{5}, nil))
+
+	for off := uint64(0); off < 6; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, want[off].Timestamp, record.Timestamp)
+		switch off {
+		case 1, 4:
+			require.Equal(t, []byte("redacted"), record.Value)
+			require.Empty(t, record.Headers)
+		case 5:
+			require.Equal(t, make([]byte, len(want[off].Value)), record.Value)
+		default:
+			require.Equal(t, want[off].Value, record.Value)
+			require.Equal(t, want[off].Headers, record.Headers)
+		}
+	}
+	// the next append still lands after the redacted records
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
+
+func TestLogCreateDir(t *testing.T) {
+	parent, err := ioutil.TempDir("", "log-create-dir-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	dir := path.Join(parent, "data", "log")
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+
+	createDir := false
+	c := Config{CreateDir: &createDir}
+	missing := path.Join(parent, "missing")
+	_, err = NewLog(missing, c)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	require.Contains(t, err.Error(), missing)
+	_, err = os.Stat(missing)
+	require.True(t, os.IsNotExist(err))
+
+	// an existing directory opens either way
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
+
+func TestLogExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-exists-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	c.CompactDirtyRatio = 0.1
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 8)
+	require.NoError(t, l.Truncate(rollOffset+3))
+	require.NoError(t, l.Delete(rollOffset+4))
+	require.NoError(t, l.Delete(rollOffset+7))
+	require.NoError(t, l.Compact())
+
+	for _, tc := range []struct {
+		off    uint64
+		exists bool
+	}{
+		{0, false},
+		{rollOffset + 2, false},
+		{rollOffset + 3, true},
+		{rollOffset + 4, false},
+		{rollOffset + 5, true},
+		{rollOffset + 6, true},
+		{rollOffset + 7, false},
+		{rollOffset + 8, false},
+		{rollOffset + 100, false},
+	} {
+		exists, err := l.Exists(tc.off)
+		require.NoError(t, err)
+		require.Equal(t, tc.exists, exists, "offset %d", tc.off)
+	}
+}
+
+func TestLogAppendValidator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-validator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	errEmpty := errors.New("empty value")
+	c := Config{}
+	c.AppendValidator = func(record *api.Record) error {
+		if len(record.Value) == 0 {
+			return errEmpty
+		}
+		return nil
+	}
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = l.Append(&api.Record{})
+	require.True(t, errors.Is(err, errEmpty))
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+	exists, err := l.Exists(0)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func TestLogCompressMinBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compress-min-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.CompressMinBytes = 100
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	value := func(off uint64) []byte {
+		if off%2 == 0 {
+			return []byte("small")
+		}
+		return bytes.Repeat([]byte{byte('a' + off)}, 1000)
+	}
+	for i := uint64(0); i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: value(i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.CompressSealed())
+	require.True(t, l.segments[0].Compressed())
+
+	for off := uint64(0); off < 4; off++ {
+		p, codec, err := l.ReadRaw(off)
+		require.NoError(t, err)
+		require.Equal(t, CodecFlateSelective, codec)
+		if off%2 == 0 {
+			// stored as it is, marker first
+			require.Equal(t, byte(0), p[0])
+			require.True(t, bytes.Contains(p, value(off)))
+		} else {
+			require.Equal(t, byte(1), p[0])
+			require.Less(t, len(p), 100)
+		}
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value(off), record.Value)
+		record, err = DecodeRaw(p, codec)
+		require.NoError(t, err)
+		require.Equal(t, value(off), record.Value)
+	}
+}
+
+func TestLogCompressSealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compress-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.CompactDirtyRatio = 0.1
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	value := func(off uint64) []byte {
+		return bytes.Repeat([]byte{byte('a' + off)}, 1000)
+	}
+	for i := uint64(0); i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: value(i)})
+		require.NoError(t, err)
+	}
+	requireSegments(t, l, 3)
+	sealed := l.segments[0].store.size
+
+	require.NoError(t, l.CompressSealed())
+	l.mu.RLock()
+	require.True(t, l.segments[0].Compressed())
+	require.True(t, l.segments[1].Compressed())
+	require.False(t, l.activeSegment.Compressed())
+	require.Less(t, l.segments[0].store.size, sealed/10)
+	l.mu.RUnlock()
+	requireRecords := func(l *Log, deleted uint64) {
+		t.Helper()
+		for off := uint64(0); off < 11; off++ {
+			record, err := l.Read(off)
+			if off == deleted {
+				require.Equal(t, ErrRecordDeleted, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, value(off), record.Value)
+		}
+	}
+	_, err = l.Append(&api.Record{Value: value(10)})
+	require.NoError(t, err)
+	requireRecords(l, 100)
+
+	// compressed segments stay compressed when they're defragmented and reopened
+	require.NoError(t, l.Delete(1))
+	require.NoError(t, l.Compact())
+	require.NoError(t, l.Close())
+	l, err = newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.True(t, l.segments[0].Compressed())
+	requireRecords(l, 1)
+}
+
+func TestLogCompressInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compress-interval-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	c.CompressInterval = time.Millisecond
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	appendRolls(t, l, 4)
+	require.Eventually(t, func() bool {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		return l.segments[0].Compressed()
+	}, time.Second, time.Millisecond)
+	for off := uint64(rollOffset); off < rollOffset+4; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, rollRecord().Value, record.Value)
+	}
+	require.NoError(t, l.Close())
+}
+
+func TestLogIdleDuration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-idle-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	l, err := newTestLog(dir, Config{Clock: clock})
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, time.Duration(0), l.IdleDuration())
+
+	clock.now = clock.now.Add(time.Minute)
+	require.Equal(t, time.Minute, l.IdleDuration())
+	clock.now = clock.now.Add(time.Hour)
+	require.Equal(t, time.Hour+time.Minute, l.IdleDuration())
+
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), l.IdleDuration())
+	clock.now = clock.now.Add(time.Second)
+	require.Equal(t, time.Second, l.IdleDuration())
+}
+
+func TestLogClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-closed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// close while another goroutine is appending
+	appended := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if i == 10 {
+				close(appended)
+			}
+			if _, err := l.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	<-appended
+	require.NoError(t, l.Close())
+	require.Equal(t, ErrLogClosed, <-errs)
+
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.Read(0)
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.Subscribe(1)
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.Iterator(0).Next()
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.ReverseIterator(0).Next()
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.ReadMany([]uint64{0})
+	require.Equal(t, ErrLogClosed, err)
+	_, _, err = l.ReadUpToBytes(0, 1024)
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.LookupLatest([]byte("key"))
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.HighestOffset()
+	require.Equal(t, ErrLogClosed, err)
+	_, err = l.Checksum()
+	require.Equal(t, ErrLogClosed, err)
+	require.Equal(t, ErrLogClosed, l.Truncate(0))
+	require.Equal(t, ErrLogClosed, l.Delete(0))
+	require.Equal(t, ErrLogClosed, l.Compact())
+	require.Equal(t, ErrLogClosed, l.WaitForOffset(context.Background(), 100))
+	_, err = l.Reader().Read(make([]byte, 1))
+	require.Equal(t, ErrLogClosed, err)
+	require.NoError(t, l.Close())
+}
+
+func TestLogCloseWakesWaiters(t *testing.T) {
+	l, err := NewMemLog(Config{})
+	require.NoError(t, err)
+	waited := make(chan error, 1)
+	go func() {
+		waited <- l.WaitForOffset(context.Background(), 0)
+	}()
+	consumed := make(chan error, 1)
+	go func() {
+		_, err := l.Consumer(ConsumerConfig{Block: true}).Next()
+		consumed <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, l.Close())
+	require.Equal(t, ErrLogClosed, <-waited)
+	require.Equal(t, ErrLogClosed, <-consumed)
+}
+
+func TestLogTryAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-try-append-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the validator holds up records valued "stall" so an append is stuck in flight
+	stalled, release := make(chan struct{}), make(chan struct{})
+	c := Config{}
+	c.MaxConcurrentAppends = 1
+	c.AppendValidator = func(record *api.Record) error {
+		if string(record.Value) == "stall" {
+			close(stalled)
+			<-release
+		}
+		return nil
+	}
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	off, ok, err := l.TryAppend(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), off)
+
+	stuck := make(chan error)
+	go func() {
+		_, err := l.Append(&api.Record{Value: []byte("stall")})
+		stuck <- err
+	}()
+	<-stalled
+	_, ok, err = l.TryAppend(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	waiting := make(chan uint64)
+	go func() {
+		off, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		waiting <- off
+	}()
+	select {
+	case <-waiting:
+		t.Fatal("append didn't wait for a slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-stuck)
+	require.Equal(t, uint64(2), <-waiting)
+}
+
+func TestLogWriteAmplification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-write-amplification-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 2))
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, float64(0), l.Stats().WriteAmplification)
+	appendRolls(t, l, 5)
+
+	record := rollRecord()
+	record.Offset = rollOffset
+	record.Timestamp = l.Config.Clock.Now().UnixNano()
+	n := float64(proto.Size(record))
+	require.InDelta(t, (lenWidth+n)/n, l.Stats().WriteAmplification, 1e-9)
+}
+
+func TestLogTruncatePastEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-truncate-past-end-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Truncate(10))
+	requireSegments(t, l, 1)
+	_, err = l.Read(0)
+	require.IsType(t, api.ErrOffsetBelowWatermark{}, err)
+	_, err = l.LowestOffset()
+	require.NoError(t, err)
+	_, err = l.HighestOffset()
+	require.NoError(t, err)
+
+	// the log carries on where it left off, also after reopening
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, l.Close())
+	l, err = newTestLog(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	record, err := l.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+}
@@ -0,0 +1,172 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"sync/atomic"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+/*
+KeyHeader is the header holding a record's key for LookupLatest.
+*/
+const KeyHeader = "key"
+
+var ErrKeyNotFound = errors.New("log: key not found")
+
+const (
+	// bits per key and hash functions, for about a 1% false positive rate
+	filterBitsPerKey = 10
+	filterHashes     = 7
+)
+
+/*
+LookupLatest returns the newest record whose KeyHeader is key, searching the newest segment first and stopping at the
+first match. Sealed segments get a bloom filter of their keys the first time they're searched so the ones that can't
+hold the key are skipped without reading them. The active segment is always scanned.
+*/
+func (l *Log) LookupLatest(key []byte) (*api.Record, error) {
+	if err := l.buildKeyFilters(); err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s.keys != nil && !s.keys.mayContain(key) {
+			continue
+		}
+		off, err := s.lookupLatest(key)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		record.Offset = l.offset(off)
+		atomic.AddUint64(&l.reads, 1)
+		return record, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+/*
+buildKeyFilters builds the filters of sealed segments that don't have one yet. Building one mutates the segment, so
+it takes the write lock, but only when there's something to build.
+*/
+func (l *Log) buildKeyFilters() error {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return ErrLogClosed
+	}
+	missing := false
+	for _, s := range l.segments {
+		missing = missing || (s != l.activeSegment && s.keys == nil)
+	}
+	l.mu.RUnlock()
+	if !missing {
+		return nil
+	}
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	for _, s := range l.segments {
+		if s == l.activeSegment || s.keys != nil {
+			continue
+		}
+		if err := s.buildKeyFilter(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+lookupLatest scans the segment's records newest first for the key, decoding only their headers.
+*/
+func (s *segment) lookupLatest(key []byte) (uint64, error) {
+	for off := s.nextOffset; off > s.baseOffset; off-- {
+		headers, err := s.ReadHeaders(off - 1)
+		if err == ErrRecordDeleted {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if k, ok := headers[KeyHeader]; ok && bytes.Equal(k, key) {
+			return off - 1, nil
+		}
+	}
+	return 0, ErrKeyNotFound
+}
+
+func (s *segment) buildKeyFilter() error {
+	var keys [][]byte
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		headers, err := s.ReadHeaders(off)
+		if err == ErrRecordDeleted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if k, ok := headers[KeyHeader]; ok {
+			keys = append(keys, k)
+		}
+	}
+	s.keys = newKeyFilter(keys)
+	return nil
+}
+
+/*
+keyFilter is a bloom filter over a sealed segment's keys. Records are only ever removed from sealed segments, which at
+worst leaves false positives.
+*/
+type keyFilter struct {
+	bits []uint64
+}
+
+func newKeyFilter(keys [][]byte) *keyFilter {
+	n := uint64(len(keys)) * filterBitsPerKey
+	f := &keyFilter{bits: make([]uint64, n/64+1)}
+	for _, key := range keys {
+		f.each(key, func(bit uint64) {
+			f.bits[bit/64] |= 1 << (bit % 64)
+		})
+	}
+	return f
+}
+
+func (f *keyFilter) mayContain(key []byte) bool {
+	contains := true
+	f.each(key, func(bit uint64) {
+		contains = contains && f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return contains
+}
+
+/*
+each calls fn with the key's bits, derived from two halves of one FNV hash by double hashing.
+*/
+func (f *keyFilter) each(key []byte, fn func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < filterHashes; i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
@@ -0,0 +1,80 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLookupLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-lookup-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	keyed := func(key string, value string) *api.Record {
+		return &api.Record{Value: []byte(value), Headers: map[string][]byte{KeyHeader: []byte(key)}}
+	}
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(keyed("a", fmt.Sprintf("a%d", i)))
+		require.NoError(t, err)
+		_, err = l.Append(keyed(fmt.Sprintf("k%d", i), "v"))
+		require.NoError(t, err)
+	}
+	_, err = l.Append(&api.Record{Value: []byte("unkeyed")})
+	require.NoError(t, err)
+	requireSegments(t, l, 6)
+
+	record, err := l.LookupLatest([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "a9", string(record.Value))
+	require.Equal(t, uint64(18), record.Offset)
+
+	// in a sealed segment
+	record, err = l.LookupLatest([]byte("k2"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), record.Offset)
+
+	_, err = l.LookupLatest([]byte("missing"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// an append after the filters are built is found too
+	off, err := l.Append(keyed("a", "newest"))
+	require.NoError(t, err)
+	record, err = l.LookupLatest([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, "newest", string(record.Value))
+
+	// a deleted record isn't found
+	require.NoError(t, l.Delete(5))
+	_, err = l.LookupLatest([]byte("k2"))
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestKeyFilter(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+	}
+	f := newKeyFilter(keys)
+	for _, key := range keys {
+		require.True(t, f.mayContain(key))
+	}
+	var falsePositives int
+	for i := 0; i < 1000; i++ {
+		if f.mayContain([]byte(fmt.Sprintf("other-%d", i))) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 50)
+	require.False(t, newKeyFilter(nil).mayContain([]byte("key")))
+}
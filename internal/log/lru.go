@@ -0,0 +1,369 @@
+package log
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+/*
+filePool is the file system of logs with Config.MaxOpenSegments. Stores and indexes opened through it are pooledFiles
+grouped by segment, and once more than max segments have files open it closes those of the least recently used ones
+that aren't pinned or in use. A pooled file reopens itself the next time it's used. Everything else is passed through
+to the file system underneath.
+*/
+type filePool struct {
+	fileSystem
+	max int
+	mu  sync.Mutex
+	// segments is keyed by the segment's files' path without the extension
+	segments map[string]*pooledSegment
+	// lru holds the segments with files open, most recently used first
+	lru *list.List
+}
+
+type pooledSegment struct {
+	key   string
+	files []*pooledFile
+	// elem is the segment's element in lru, nil if none of its files are open
+	elem *list.Element
+	// users counts the operations in flight on the segment's files, which can't be closed under them
+	users  int
+	pinned bool
+}
+
+/*
+pooledFile is a store or index file of a filePool. Its OS file, f, is nil while the pool has it closed. The pool's lock
+guards all of it, but f doesn't change while the segment has users so operations use it without the lock.
+*/
+type pooledFile struct {
+	pool   *filePool
+	seg    *pooledSegment
+	name   string
+	flag   int
+	perm   os.FileMode
+	f      *os.File
+	off    int64
+	closed bool
+}
+
+func newFilePool(fs fileSystem, max int) *filePool {
+	if p, ok := fs.(*filePool); ok {
+		fs = p.fileSystem
+	}
+	return &filePool{fileSystem: fs, max: max, segments: make(map[string]*pooledSegment), lru: list.New()}
+}
+
+/*
+segmentKey returns the key for the segment a store or index file belongs to, or false for any other file.
+*/
+func segmentKey(name string) (string, bool) {
+	name = path.Clean(name)
+	for _, ext := range []string{".store", ".index"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return "", false
+}
+
+func (p *filePool) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	key, ok := segmentKey(name)
+	if !ok {
+		return p.fileSystem.OpenFile(name, flag, perm)
+	}
+	f, err := p.fileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return f, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seg, ok := p.segments[key]
+	if !ok {
+		seg = &pooledSegment{key: key}
+		p.segments[key] = seg
+	}
+	pf := &pooledFile{
+		pool: p,
+		seg:  seg,
+		name: name,
+		// reopening mustn't create or truncate the file again
+		flag: flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC),
+		perm: perm,
+		f:    osFile,
+	}
+	seg.files = append(seg.files, pf)
+	p.touch(seg)
+	return pf, p.evict()
+}
+
+/*
+pin keeps the files of the segment the file belongs to open, or lets the pool close them again, for the active segment.
+*/
+func (p *filePool) pin(f file, pinned bool) {
+	pf, ok := f.(*pooledFile)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pf.seg.pinned = pinned
+	if pinned {
+		p.touch(pf.seg)
+	}
+	// see done
+	p.evict()
+}
+
+/*
+touch moves the segment to the front of lru. Callers must hold the lock.
+*/
+func (p *filePool) touch(seg *pooledSegment) {
+	if seg.elem == nil {
+		seg.elem = p.lru.PushFront(seg)
+		return
+	}
+	p.lru.MoveToFront(seg.elem)
+}
+
+/*
+evict closes the files of the least recently used segments it can until no more than max have files open. Callers must
+hold the lock.
+*/
+func (p *filePool) evict() error {
+	for e := p.lru.Back(); e != nil && p.lru.Len() > p.max; {
+		seg := e.Value.(*pooledSegment)
+		e = e.Prev()
+		if seg.users > 0 || seg.pinned {
+			continue
+		}
+		if err := p.closeSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+closeSegment closes the segment's open files, remembering their offsets for when they're reopened. Callers must hold
+the lock.
+*/
+func (p *filePool) closeSegment(seg *pooledSegment) error {
+	p.lru.Remove(seg.elem)
+	seg.elem = nil
+	for _, pf := range seg.files {
+		if pf.f == nil {
+			continue
+		}
+		off, err := pf.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		err = pf.f.Close()
+		pf.f, pf.off = nil, off
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+use returns the file's OS file, reopening it if the pool closed it, and holds it open until done is called.
+*/
+func (pf *pooledFile) use() (*os.File, error) {
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pf.closed {
+		return nil, os.ErrClosed
+	}
+	if pf.f == nil {
+		f, err := os.OpenFile(pf.name, pf.flag, pf.perm)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Seek(pf.off, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		pf.f = f
+	}
+	pf.seg.users++
+	p.touch(pf.seg)
+	if err := p.evict(); err != nil {
+		pf.seg.users--
+		return nil, err
+	}
+	return pf.f, nil
+}
+
+func (pf *pooledFile) done() {
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pf.seg.users--
+	// closing other segments only fails on errors it'll hit again when it next evicts
+	p.evict()
+}
+
+/*
+isOpen reports whether the file's OS file is open, for Log.OpenFileCount.
+*/
+func (pf *pooledFile) isOpen() bool {
+	pf.pool.mu.Lock()
+	defer pf.pool.mu.Unlock()
+	return pf.f != nil
+}
+
+/*
+detach takes the file out of the pool, opening it for good, for custom indexes from Config.Segment.NewIndex that hold
+on to the *os.File they're given.
+*/
+func (pf *pooledFile) detach() (*os.File, error) {
+	f, err := pf.use()
+	if err != nil {
+		return nil, err
+	}
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pf.seg.users--
+	pf.f = nil
+	pf.remove()
+	return f, nil
+}
+
+/*
+remove drops the file from its segment, and the segment from lru when none of the files left are open or from the pool
+when there are none left. Callers must hold the lock.
+*/
+func (pf *pooledFile) remove() {
+	p, seg := pf.pool, pf.seg
+	pf.closed = true
+	for i, other := range seg.files {
+		if other == pf {
+			seg.files = append(seg.files[:i], seg.files[i+1:]...)
+			break
+		}
+	}
+	for _, other := range seg.files {
+		if other.f != nil {
+			return
+		}
+	}
+	if seg.elem != nil {
+		p.lru.Remove(seg.elem)
+		seg.elem = nil
+	}
+	if len(seg.files) == 0 && p.segments[seg.key] == seg {
+		delete(p.segments, seg.key)
+	}
+}
+
+func (pf *pooledFile) Name() string { return pf.name }
+
+func (pf *pooledFile) Read(b []byte) (int, error) {
+	f, err := pf.use()
+	if err != nil {
+		return 0, err
+	}
+	defer pf.done()
+	return f.Read(b)
+}
+
+func (pf *pooledFile) ReadAt(b []byte, off int64) (int, error) {
+	f, err := pf.use()
+	if err != nil {
+		return 0, err
+	}
+	defer pf.done()
+	return f.ReadAt(b, off)
+}
+
+func (pf *pooledFile) Write(b []byte) (int, error) {
+	f, err := pf.use()
+	if err != nil {
+		return 0, err
+	}
+	defer pf.done()
+	return f.Write(b)
+}
+
+func (pf *pooledFile) Seek(offset int64, whence int) (int64, error) {
+	f, err := pf.use()
+	if err != nil {
+		return 0, err
+	}
+	defer pf.done()
+	return f.Seek(offset, whence)
+}
+
+func (pf *pooledFile) Stat() (os.FileInfo, error) {
+	f, err := pf.use()
+	if err != nil {
+		return nil, err
+	}
+	defer pf.done()
+	return f.Stat()
+}
+
+func (pf *pooledFile) Truncate(size int64) error {
+	f, err := pf.use()
+	if err != nil {
+		return err
+	}
+	defer pf.done()
+	return f.Truncate(size)
+}
+
+func (pf *pooledFile) Sync() error {
+	f, err := pf.use()
+	if err != nil {
+		return err
+	}
+	defer pf.done()
+	return f.Sync()
+}
+
+func (pf *pooledFile) Close() error {
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pf.closed {
+		return os.ErrClosed
+	}
+	f := pf.f
+	pf.f = nil
+	pf.remove()
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
+
+/*
+withOSFile calls fn with the OS file behind f, holding pooled files open while it runs, and reports false without
+calling it if there isn't one, as for in-memory files.
+*/
+func withOSFile(f file, fn func(*os.File) error) (bool, error) {
+	switch f := f.(type) {
+	case *os.File:
+		return true, fn(f)
+	case *pooledFile:
+		osFile, err := f.use()
+		if err != nil {
+			return true, err
+		}
+		defer f.done()
+		return true, fn(osFile)
+	}
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMaxOpenSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-open-segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 2)
+	c.MaxOpenSegments = 2
+	// two segments' stores and indexes and the directory's lock
+	bound := 2*c.MaxOpenSegments + 1
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		appendRolls(t, l, 1)
+		require.LessOrEqual(t, l.OpenFileCount(), bound)
+	}
+	requireSegments(t, l, 11)
+	require.Equal(t, bound, l.OpenFileCount())
+
+	// reading an old segment reopens it, closing another sealed one but never the active one
+	oldest := l.segments[0]
+	require.False(t, isOpen(oldest.store.File))
+	record, err := l.Read(rollOffset)
+	require.NoError(t, err)
+	require.Equal(t, rollRecord().Value, record.Value)
+	require.True(t, isOpen(oldest.store.File))
+	require.True(t, isOpen(l.activeSegment.store.File))
+	// indexes are read through their memory maps, so only the store had to be reopened
+	require.False(t, isOpen(oldest.index.(*index).file))
+	require.Equal(t, bound-1, l.OpenFileCount())
+	requireMemRecords(t, l, rollOffset, rollOffset+19)
+	require.LessOrEqual(t, l.OpenFileCount(), bound)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for off := uint64(rollOffset + i); off < rollOffset+20; off += 4 {
+				_, err := l.Read(off)
+				require.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, l.OpenFileCount(), bound)
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.LessOrEqual(t, l.OpenFileCount(), bound)
+	requireMemRecords(t, l, rollOffset, rollOffset+19)
+}
+
+/*
+TestLogMaxOpenSegmentsScenarios runs the in-memory log's scenarios on disk with a single segment allowed open, so every
+read of a sealed segment closes and reopens files.
+*/
+func TestLogMaxOpenSegmentsScenarios(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"append and read across rolls and reopens": testMemAppendRead,
+		"truncate and purge deleted segments":      testMemPurgeDeleted,
+		"delete and compact records":               testMemCompact,
+		"coalesce sealed segments":                 testMemCoalesce,
+		"copy to another directory":                testMemCopy,
+		"reopen from the manifest":                 testMemManifest,
+		"preallocate stores":                       testMemPreallocate,
+		"remove the log":                           testMemRemove,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-max-open-segments-scenario-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := rollConfig(t, 2)
+			c.MaxOpenSegments = 1
+			fn(t, dir, c)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path"
+)
+
+const (
+	manifestName = "log.manifest"
+	// base offset, next offset, store bytes, index bytes, payload bytes, dirty bytes and the sealed flag
+	manifestEntWidth = 6*8 + 1
+)
+
+var errBadManifest = errors.New("log: bad manifest")
+
+/*
+manifestEntry is what the manifest remembers about a segment so opening it can skip scanning its store and index.
+*/
+type manifestEntry struct {
+	baseOffset uint64
+	nextOffset uint64
+	storeBytes uint64
+	indexBytes uint64
+	payload    uint64
+	dirty      uint64
+	sealed     bool
+}
+
+/*
+saveManifest writes the manifest of the log's segments when Config.Manifest is set. It's written to a temporary file
+and renamed over the old one so a crash leaves one or the other. Callers must hold the write lock.
+*/
+func (l *Log) saveManifest() error {
+	if !l.Config.Manifest {
+		return nil
+	}
+	p := make([]byte, 8, 8+len(l.segments)*manifestEntWidth+crcWidth)
+	enc.PutUint64(p, uint64(len(l.segments)))
+	for _, s := range l.segments {
+		e := make([]byte, manifestEntWidth)
+		enc.PutUint64(e[0:], s.baseOffset)
+		enc.PutUint64(e[8:], s.nextOffset)
+		enc.PutUint64(e[16:], s.store.size)
+		enc.PutUint64(e[24:], s.index.Size())
+		enc.PutUint64(e[32:], s.store.payload)
+		enc.PutUint64(e[40:], s.dirty)
+		if s != l.activeSegment {
+			e[48] = 1
+		}
+		p = append(p, e...)
+	}
+	crc := make([]byte, crcWidth)
+	enc.PutUint32(crc, crc32.ChecksumIEEE(p))
+	p = append(p, crc...)
+	name := path.Join(l.Dir, manifestName)
+	if err := writeFile(l.Config.fileSystem(), name+tempSuffix, p); err != nil {
+		return err
+	}
+	return l.Config.fileSystem().Rename(name+tempSuffix, name)
+}
+
+/*
+readManifest reads the manifest in dir keyed by base offset.
+*/
+func readManifest(fs fileSystem, dir string) (map[uint64]manifestEntry, error) {
+	p, err := readFile(fs, path.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	if len(p) < 8+crcWidth {
+		return nil, errBadManifest
+	}
+	body, crc := p[:len(p)-crcWidth], p[len(p)-crcWidth:]
+	if enc.Uint32(crc) != crc32.ChecksumIEEE(body) {
+		return nil, errBadManifest
+	}
+	n := enc.Uint64(body)
+	if uint64(len(body)-8) != n*manifestEntWidth {
+		return nil, errBadManifest
+	}
+	entries := make(map[uint64]manifestEntry, n)
+	for e := body[8:]; len(e) > 0; e = e[manifestEntWidth:] {
+		entry := manifestEntry{
+			baseOffset: enc.Uint64(e[0:]),
+			nextOffset: enc.Uint64(e[8:]),
+			storeBytes: enc.Uint64(e[16:]),
+			indexBytes: enc.Uint64(e[24:]),
+			payload:    enc.Uint64(e[32:]),
+			dirty:      enc.Uint64(e[40:]),
+			sealed:     e[48] == 1,
+		}
+		entries[entry.baseOffset] = entry
+	}
+	return entries, nil
+}
+
+/*
+trustedManifest returns the manifest entries to open segments from, or nil if there's no manifest or it doesn't list
+exactly the segments whose files are in the directory, as happens when it's stale.
+*/
+func (l *Log) trustedManifest(baseOffsets []uint64) map[uint64]manifestEntry {
+	if !l.Config.Manifest {
+		return nil
+	}
+	entries, err := readManifest(l.Config.fileSystem(), l.Dir)
+	if err != nil {
+		return nil
+	}
+	found := make(map[uint64]bool)
+	for _, off := range baseOffsets {
+		if _, ok := entries[off]; !ok {
+			return nil
+		}
+		found[off] = true
+	}
+	if len(found) != len(entries) {
+		return nil
+	}
+	return entries
+}
+
+/*
+matches reports whether the segment's files on disk are the sizes the manifest says, which they are unless the
+segment was changed after the manifest was written or the log wasn't closed cleanly, leaving its index grown.
+*/
+func (e manifestEntry) matches(fs fileSystem, dir string) bool {
+	for name, size := range map[string]uint64{
+		path.Join(dir, fmt.Sprintf("%d%s", e.baseOffset, ".store")): e.storeBytes,
+		path.Join(dir, fmt.Sprintf("%d%s", e.baseOffset, ".index")): e.indexBytes,
+	} {
+		fi, err := fs.Stat(name)
+		if err != nil || uint64(fi.Size()) != size {
+			return false
+		}
+	}
+	return true
+}
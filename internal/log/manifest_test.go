@@ -0,0 +1,114 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-manifest-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 2)
+	c.Manifest = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRolls(t, l, 7)
+	require.NoError(t, l.Delete(rollOffset+2))
+	require.NoError(t, l.Truncate(rollOffset+1))
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Close())
+	_, err = os.Stat(path.Join(dir, manifestName))
+	require.NoError(t, err)
+
+	describe := func(c Config) []byte {
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer l.Close()
+		for off := uint64(rollOffset + 3); off < rollOffset+7; off++ {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, rollRecord().Value, record.Value)
+		}
+		d, err := l.DescribeJSON()
+		require.NoError(t, err)
+		return d
+	}
+	scanned := c
+	scanned.Manifest = false
+	want := describe(scanned)
+	require.Equal(t, string(want), string(describe(c)))
+
+	// sealed segments are opened from the manifest rather than scanned
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	l.segments[0].dirty = 12345
+	require.NoError(t, l.Close())
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12345), l.segments[0].dirty)
+	require.NoError(t, l.Close())
+
+	// a stale manifest is ignored for the segments it doesn't match
+	stale, err := ioutil.ReadFile(path.Join(dir, manifestName))
+	require.NoError(t, err)
+	l, err = NewLog(dir, scanned)
+	require.NoError(t, err)
+	require.NoError(t, l.segments[0].Defragment())
+	require.NoError(t, l.Close())
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, manifestName), stale, 0644))
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), l.segments[0].dirty)
+	require.NoError(t, l.Close())
+
+	// without a manifest the log is scanned
+	require.NoError(t, os.Remove(path.Join(dir, manifestName)))
+	require.NotEqual(t, string(want), string(describe(c)))
+	require.Equal(t, string(describe(scanned)), string(describe(c)))
+}
+
+/*
+BenchmarkNewLogManifest times opening a log of many sealed segments by scanning them and from a manifest.
+*/
+func BenchmarkNewLogManifest(b *testing.B) {
+	dir, err := ioutil.TempDir("", "log-manifest-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Manifest = true
+	c.Segment.MaxStoreBytes = 64 << 10
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := NewLog(dir, c)
+	require.NoError(b, err)
+	for i := 0; i < 20000; i++ {
+		_, err = l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(b, err)
+	}
+	require.NoError(b, l.Close())
+
+	for _, manifest := range []bool{false, true} {
+		c.Manifest = manifest
+		b.Run(fmt.Sprintf("manifest=%t", manifest), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				l, err := NewLog(dir, c)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err = l.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
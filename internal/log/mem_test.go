@@ -0,0 +1,280 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+TestMemLog runs the same scenarios against a log on disk and one in memory, which should behave the same.
+*/
+func TestMemLog(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"append and read across rolls and reopens": testMemAppendRead,
+		"truncate and purge deleted segments":      testMemPurgeDeleted,
+		"delete and compact records":               testMemCompact,
+		"coalesce sealed segments":                 testMemCoalesce,
+		"copy to another directory":                testMemCopy,
+		"reopen from the manifest":                 testMemManifest,
+		"preallocate stores":                       testMemPreallocate,
+		"remove the log":                           testMemRemove,
+	} {
+		t.Run(scenario+" on disk", func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mem-log-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, dir, rollConfig(t, 2))
+		})
+		t.Run(scenario+" in memory", func(t *testing.T) {
+			c := rollConfig(t, 2)
+			c.InMemory = true
+			// reopening the log needs the same file system, which NewLog would otherwise make afresh
+			c.fs = newMemFS()
+			dir := path.Join(os.TempDir(), "mem-log-test-in-memory")
+			fn(t, dir, c)
+			_, err := os.Stat(dir)
+			require.True(t, os.IsNotExist(err), "in-memory log touched the disk")
+		})
+	}
+}
+
+/*
+suiteMemFS, while TestMemLogSuite runs a test, is the file system newTestLog keeps the test's logs in.
+*/
+var suiteMemFS *memFS
+
+/*
+newTestLog opens a log like NewLog for the tests TestMemLogSuite runs, in memory while it's running them.
+*/
+func newTestLog(dir string, c Config) (*Log, error) {
+	if suiteMemFS != nil && c.fs == nil {
+		c.InMemory, c.fs = true, suiteMemFS
+	}
+	return NewLog(dir, c)
+}
+
+/*
+TestMemLogSuite runs the package's log tests again with every log they open through newTestLog kept in memory. Left out
+are the tests that look at the files on disk themselves or need them, for syncers, custom indexes, directory locks and
+the file pool.
+*/
+func TestMemLogSuite(t *testing.T) {
+	for name, fn := range map[string]func(t *testing.T){
+		"TestLogApplyConfig":             TestLogApplyConfig,
+		"TestLogAppendAsync":             TestLogAppendAsync,
+		"TestLogConsumeBatch":            TestLogConsumeBatch,
+		"TestLogCoalesce":                TestLogCoalesce,
+		"TestLogCoalesceTargetMaxBytes":  TestLogCoalesceTargetMaxBytes,
+		"TestConsumer":                   TestConsumer,
+		"TestConsumerBlock":              TestConsumerBlock,
+		"TestLogAppendEpoch":             TestLogAppendEpoch,
+		"TestIterator":                   TestIterator,
+		"TestReverseIterator":            TestReverseIterator,
+		"TestLogCopy":                    TestLogCopy,
+		"TestLogMixedFormatVersions":     TestLogMixedFormatVersions,
+		"TestLogSubscriberStats":         TestLogSubscriberStats,
+		"TestLogSubscribeSince":          TestLogSubscribeSince,
+		"TestLogReadRelative":            TestLogReadRelative,
+		"TestLogOutOfOrderWindow":        TestLogOutOfOrderWindow,
+		"TestLogWaitForOffset":           TestLogWaitForOffset,
+		"TestLogHeaders":                 TestLogHeaders,
+		"TestLogLowWatermark":            TestLogLowWatermark,
+		"TestLogTotalPayloadBytes":       TestLogTotalPayloadBytes,
+		"TestLogTotalRecords":            TestLogTotalRecords,
+		"TestLogReadMany":                TestLogReadMany,
+		"TestLogSegmentRouting":          TestLogSegmentRouting,
+		"TestLogSyncOnRoll":              TestLogSyncOnRoll,
+		"TestLogDumpIndex":               TestLogDumpIndex,
+		"TestLogReadWithPosition":        TestLogReadWithPosition,
+		"TestLogCompact":                 TestLogCompact,
+		"TestLogChecksum":                TestLogChecksum,
+		"TestLogClock":                   TestLogClock,
+		"TestLogOffsetAllocator":         TestLogOffsetAllocator,
+		"TestLogReadUpToBytes":           TestLogReadUpToBytes,
+		"TestLogReadUpToBytesPagination": TestLogReadUpToBytesPagination,
+		"TestLogOnRoll":                  TestLogOnRoll,
+		"TestLogDescribeJSON":            TestLogDescribeJSON,
+		"TestLogRedact":                  TestLogRedact,
+		"TestLogExists":                  TestLogExists,
+		"TestLogAppendValidator":         TestLogAppendValidator,
+		"TestLogCompressMinBytes":        TestLogCompressMinBytes,
+		"TestLogCompressSealed":          TestLogCompressSealed,
+		"TestLogCompressInterval":        TestLogCompressInterval,
+		"TestLogIdleDuration":            TestLogIdleDuration,
+		"TestLogClosed":                  TestLogClosed,
+		"TestLogTryAppend":               TestLogTryAppend,
+		"TestLogWriteAmplification":      TestLogWriteAmplification,
+		"TestLogTruncatePastEnd":         TestLogTruncatePastEnd,
+		"TestLogLookupLatest":            TestLogLookupLatest,
+		"TestLogReadRaw":                 TestLogReadRaw,
+		"TestNewRecord":                  TestNewRecord,
+		"TestRollConfig":                 TestRollConfig,
+		"TestRollSegmentRouter":          TestRollSegmentRouter,
+		"TestLogSeekTime":                TestLogSeekTime,
+		"TestLogWarmup":                  TestLogWarmup,
+	} {
+		t.Run(name, func(t *testing.T) {
+			suiteMemFS = newMemFS()
+			defer func() { suiteMemFS = nil }()
+			fn(t)
+		})
+	}
+}
+
+func testMemAppendRead(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRolls(t, l, 5)
+	requireSegments(t, l, 3)
+	requireMemRecords(t, l, rollOffset, rollOffset+4)
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	requireSegments(t, l, 3)
+	requireMemRecords(t, l, rollOffset, rollOffset+4)
+	off, err := l.Append(rollRecord())
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+5), off)
+}
+
+func testMemPurgeDeleted(t *testing.T, dir string, c Config) {
+	clock := c.Clock.(*fakeClock)
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 5)
+	require.NoError(t, l.Truncate(rollOffset+2))
+	requireSegments(t, l, 2)
+	deleted := path.Join(dir, "16.store"+deletedSuffix)
+	_, err = c.fileSystem().Stat(deleted)
+	require.NoError(t, err)
+
+	require.NoError(t, l.PurgeDeleted(time.Hour))
+	_, err = c.fileSystem().Stat(deleted)
+	require.NoError(t, err)
+	clock.now = clock.now.Add(2 * time.Hour)
+	require.NoError(t, l.PurgeDeleted(time.Hour))
+	_, err = c.fileSystem().Stat(deleted)
+	require.True(t, os.IsNotExist(err))
+	requireMemRecords(t, l, rollOffset+2, rollOffset+4)
+}
+
+func testMemCompact(t *testing.T, dir string, c Config) {
+	c.CompactDirtyRatio = 0.25
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 3)
+	require.NoError(t, l.Delete(rollOffset))
+	require.NoError(t, l.Compact())
+	require.Equal(t, float64(0), l.segments[0].DirtyRatio())
+	_, err = l.Read(rollOffset)
+	require.Equal(t, ErrRecordDeleted, err)
+	requireMemRecords(t, l, rollOffset+1, rollOffset+2)
+}
+
+func testMemCoalesce(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 5)
+	requireSegments(t, l, 3)
+	require.NoError(t, l.Coalesce([]uint64{rollOffset, rollOffset + 2}, c.Segment.MaxStoreBytes*2))
+	requireSegments(t, l, 2)
+	requireMemRecords(t, l, rollOffset, rollOffset+4)
+}
+
+func testMemCopy(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 5)
+	cp, err := l.Copy(dir + "-copy")
+	require.NoError(t, err)
+	defer cp.Remove()
+	want, err := l.Checksum()
+	require.NoError(t, err)
+	got, err := cp.Checksum()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	requireMemRecords(t, cp, rollOffset, rollOffset+4)
+}
+
+func testMemManifest(t *testing.T, dir string, c Config) {
+	c.Manifest = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRolls(t, l, 5)
+	require.NoError(t, l.Close())
+	_, err = c.fileSystem().Stat(path.Join(dir, manifestName))
+	require.NoError(t, err)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	requireMemRecords(t, l, rollOffset, rollOffset+4)
+}
+
+func testMemPreallocate(t *testing.T, dir string, c Config) {
+	c.Store.Preallocate = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRolls(t, l, 3)
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 1)
+	requireMemRecords(t, l, rollOffset, rollOffset+3)
+}
+
+func testMemRemove(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRolls(t, l, 3)
+	require.NoError(t, l.Remove())
+	_, err = c.fileSystem().Stat(dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func requireMemRecords(t *testing.T, l *Log, lowest, highest uint64) {
+	t.Helper()
+	for off := lowest; off <= highest; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, rollRecord().Value, record.Value)
+	}
+	_, err := l.Read(highest + 1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func TestNewMemLog(t *testing.T) {
+	l, err := NewMemLog(Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	// there are no OS files for these
+	c := Config{}
+	c.Store.Syncer = func(f *os.File) error { return f.Sync() }
+	_, err = NewMemLog(c)
+	require.Error(t, err)
+	c = Config{}
+	c.Segment.NewIndex = func(f *os.File, c Config) (Index, error) { return newIndex(f, c) }
+	_, err = NewMemLog(c)
+	require.Error(t, err)
+}
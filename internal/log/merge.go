@@ -0,0 +1,142 @@
+package log
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+/*
+RecordStream yields records in offset order, returning io.EOF once it's done.
+*/
+type RecordStream interface {
+	Next() (*api.Record, error)
+}
+
+/*
+ErrOffsetGap is returned by Merge when no stream has the record at Offset and gaps aren't being filled.
+*/
+type ErrOffsetGap struct {
+	Offset uint64
+}
+
+func (e ErrOffsetGap) Error() string {
+	return fmt.Sprintf("log: merge has no record at offset %d", e.Offset)
+}
+
+/*
+Merge rebuilds a single contiguous log in dir from streams that each hold part of it, like reassembling a log from
+several backups. The streams are merge sorted by offset and the log starts at the lowest one. When several streams have
+the same offset the record from the first of them is kept. Offsets missing from every stream fail the merge with
+ErrOffsetGap, or with fillGaps are appended as empty records and deleted so reading them gives ErrRecordDeleted.
+*/
+func Merge(dir string, c Config, fillGaps bool, streams ...RecordStream) (*Log, error) {
+	h := &mergeHeap{}
+	for i, stream := range streams {
+		if err := h.pushNext(i, stream); err != nil {
+			return nil, err
+		}
+	}
+	if h.Len() > 0 {
+		c.Segment.InitialOffset = (*h)[0].record.Offset
+	}
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.merge(h, streams, fillGaps); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) merge(h *mergeHeap, streams []RecordStream, fillGaps bool) error {
+	next := l.Config.Segment.InitialOffset
+	for h.Len() > 0 {
+		head := heap.Pop(h).(mergeHead)
+		if err := h.pushNext(head.stream, streams[head.stream]); err != nil {
+			return err
+		}
+		off := head.record.Offset
+		if off < next {
+			// a duplicate of a record we've already appended
+			continue
+		}
+		for ; next < off; next++ {
+			if !fillGaps {
+				return ErrOffsetGap{Offset: next}
+			}
+			if err := l.appendDeleted(); err != nil {
+				return err
+			}
+		}
+		if _, err := l.Append(head.record); err != nil {
+			return err
+		}
+		next++
+	}
+	return nil
+}
+
+/*
+appendDeleted appends an empty record and tombstones it straight away.
+*/
+func (l *Log) appendDeleted() error {
+	off, err := l.Append(&api.Record{})
+	if err != nil {
+		return err
+	}
+	// deleting changes the segment, so it takes the write lock
+	return l.Delete(off)
+}
+
+type mergeHead struct {
+	record *api.Record
+	stream int
+}
+
+/*
+mergeHeap holds the next record of each stream that hasn't run out, ordered by offset and then stream.
+*/
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].record.Offset != h[j].record.Offset {
+		return h[i].record.Offset < h[j].record.Offset
+	}
+	return h[i].stream < h[j].stream
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(mergeHead))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+func (h *mergeHeap) pushNext(i int, stream RecordStream) error {
+	record, err := stream.Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(h, mergeHead{record: record, stream: i})
+	return nil
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+type sliceStream []*api.Record
+
+func (s *sliceStream) Next() (*api.Record, error) {
+	if len(*s) == 0 {
+		return nil, io.EOF
+	}
+	record := (*s)[0]
+	*s = (*s)[1:]
+	return record, nil
+}
+
+func stream(offsets ...uint64) *sliceStream {
+	s := &sliceStream{}
+	for _, off := range offsets {
+		*s = append(*s, &api.Record{Offset: off, Value: []byte(fmt.Sprintf("record %d", off))})
+	}
+	return s
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := Merge(dir, c, false,
+		stream(2, 3, 4, 5),
+		stream(5, 6, 7, 10),
+		stream(2, 8, 9),
+	)
+	require.NoError(t, err)
+	defer l.Close()
+
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), highest)
+	for off := uint64(2); off <= 10; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+}
+
+func TestMergeGaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge-gaps-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = Merge(dir, Config{}, false, stream(0, 1), stream(3))
+	require.Equal(t, ErrOffsetGap{Offset: 2}, err)
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	l, err := Merge(dir, Config{}, true, stream(0, 1), stream(4))
+	require.NoError(t, err)
+	defer l.Close()
+	for _, off := range []uint64{2, 3} {
+		_, err = l.Read(off)
+		require.Equal(t, ErrRecordDeleted, err)
+	}
+	record, err := l.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, "record 4", string(record.Value))
+}
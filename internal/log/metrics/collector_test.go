@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/dfcarpenter/proglog/internal/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	// 12 bytes per index entry, roll after two records
+	c.Segment.MaxIndexBytes = 24
+	c.Clock = fixedClock{time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = l.Read(0)
+	require.NoError(t, err)
+
+	// records marshal to 23 bytes (offset 0 is omitted) or 25 bytes with their 10 byte timestamp, plus an 8 byte
+	// length prefix and a 12 byte index entry each
+	want := fmt.Sprintf(`
+# HELP proglog_appends_total Records appended since the log was opened.
+# TYPE proglog_appends_total counter
+proglog_appends_total{dir="%[1]s"} 3
+# HELP proglog_bytes Bytes stored in the log's store and index files.
+# TYPE proglog_bytes gauge
+proglog_bytes{dir="%[1]s"} 133
+# HELP proglog_reads_total Records read since the log was opened.
+# TYPE proglog_reads_total counter
+proglog_reads_total{dir="%[1]s"} 1
+# HELP proglog_records Number of records in the log.
+# TYPE proglog_records gauge
+proglog_records{dir="%[1]s"} 3
+# HELP proglog_segments Number of segments in the log.
+# TYPE proglog_segments gauge
+proglog_segments{dir="%[1]s"} 2
+`, dir)
+	require.NoError(t, testutil.CollectAndCompare(NewCollector(l), strings.NewReader(want)))
+}
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,106 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var ErrNoCommittedOffset = errors.New("log: no committed offset for group")
+
+/*
+OffsetStore persists the offsets consumer groups have committed so they can resume where they left off. Each commit is
+appended to a store as the offset followed by the group name, and opening the store replays them so the last commit
+for each group wins.
+*/
+type OffsetStore struct {
+	mu      sync.RWMutex
+	store   *store
+	offsets map[string]uint64
+}
+
+/*
+NewOffsetStore opens the offset store at the given file path, creating it if needed. Keep it outside the log's
+directory since the log treats every file there as a segment. A commit torn by a crash is cut off the end, losing only
+that commit.
+*/
+func NewOffsetStore(name string) (*OffsetStore, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(f, Config{})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	o := &OffsetStore{store: s, offsets: make(map[string]uint64)}
+	if err = o.replay(name); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+/*
+replay truncates a torn commit off the end of the store and reads the commits before it.
+*/
+func (o *OffsetStore) replay(name string) error {
+	if _, err := o.store.truncateTorn(); err != nil {
+		return err
+	}
+	positions, err := o.store.records()
+	if err != nil {
+		return err
+	}
+	for _, pos := range positions {
+		p, err := o.store.Read(pos)
+		if err != nil {
+			return err
+		}
+		if len(p) < 8 {
+			return fmt.Errorf("log: corrupt offset commit at %d in %s", pos, name)
+		}
+		o.offsets[string(p[8:])] = enc.Uint64(p)
+	}
+	return nil
+}
+
+/*
+CommitOffset durably records offset as the group's committed offset.
+*/
+func (o *OffsetStore) CommitOffset(group string, offset uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := make([]byte, 8+len(group))
+	enc.PutUint64(p, offset)
+	copy(p[8:], group)
+	if _, _, err := o.store.Append(p); err != nil {
+		return err
+	}
+	if err := o.store.sync(); err != nil {
+		return err
+	}
+	o.offsets[group] = offset
+	return nil
+}
+
+/*
+CommittedOffset returns the group's last committed offset, or ErrNoCommittedOffset if it hasn't committed one.
+*/
+func (o *OffsetStore) CommittedOffset(group string) (uint64, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	offset, ok := o.offsets[group]
+	if !ok {
+		return 0, ErrNoCommittedOffset
+	}
+	return offset, nil
+}
+
+func (o *OffsetStore) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.store.Close()
+}
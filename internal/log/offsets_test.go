@@ -0,0 +1,61 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "offsets")
+
+	o, err := NewOffsetStore(name)
+	require.NoError(t, err)
+	_, err = o.CommittedOffset("billing")
+	require.Equal(t, ErrNoCommittedOffset, err)
+
+	require.NoError(t, o.CommitOffset("billing", 3))
+	require.NoError(t, o.CommitOffset("search", 10))
+	require.NoError(t, o.CommitOffset("billing", 7))
+	require.NoError(t, o.CommitOffset("", 1))
+
+	check := func(o *OffsetStore) {
+		for group, want := range map[string]uint64{"billing": 7, "search": 10, "": 1} {
+			got, err := o.CommittedOffset(group)
+			require.NoError(t, err)
+			require.Equal(t, want, got, group)
+		}
+	}
+	check(o)
+	require.NoError(t, o.Close())
+
+	o, err = NewOffsetStore(name)
+	require.NoError(t, err)
+	check(o)
+	_, err = o.CommittedOffset("audit")
+	require.Equal(t, ErrNoCommittedOffset, err)
+
+	// a crash partway through a commit loses only that commit
+	require.NoError(t, o.CommitOffset("search", 12))
+	require.NoError(t, o.Close())
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, fi.Size()-3))
+	o, err = NewOffsetStore(name)
+	require.NoError(t, err)
+	check(o)
+	require.NoError(t, o.CommitOffset("search", 12))
+	require.NoError(t, o.Close())
+	o, err = NewOffsetStore(name)
+	require.NoError(t, err)
+	defer o.Close()
+	got, err := o.CommittedOffset("search")
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), got)
+}
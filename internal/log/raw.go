@@ -0,0 +1,63 @@
+package log
+
+import (
+	"sync/atomic"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+ReadRaw returns the record at the given offset marshaled as it's stored, still compressed with the returned codec, for
+callers that forward or re-store records and would only compress them again. Encryption and pipelines are undone as
+for Read. DecodeRaw turns the bytes back into the record.
+*/
+func (l *Log) ReadRaw(off uint64) ([]byte, uint8, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, 0, ErrLogClosed
+	}
+	s, local, err := l.segment(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, codec, err := s.ReadRaw(local)
+	if err != nil {
+		return nil, 0, err
+	}
+	atomic.AddUint64(&l.reads, 1)
+	return p, codec, nil
+}
+
+/*
+ReadRaw returns the record at the given offset as the store holds it along with the store's codec. It's not decoded,
+so Config.Segment.VerifyReadOffset isn't checked.
+*/
+func (s *segment) ReadRaw(off uint64) ([]byte, uint8, error) {
+	pos, err := s.position(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, err := s.store.ReadRaw(pos)
+	if err != nil {
+		return nil, 0, s.corrupted(off, err)
+	}
+	return p, s.store.codec, nil
+}
+
+/*
+DecodeRaw decompresses a record ReadRaw returned with its codec and unmarshals it. The offset it holds is the one the
+log stored, which is only the offset it was read at when Config.OffsetAllocator isn't set.
+*/
+func DecodeRaw(p []byte, codec uint8) (*api.Record, error) {
+	p, err := uncompress(codec, p)
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,56 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogReadRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-raw-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	value := func(off uint64) []byte {
+		return bytes.Repeat([]byte{byte('a' + off)}, 1000)
+	}
+	for i := uint64(0); i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: value(i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.CompressSealed())
+	require.True(t, l.segments[0].Compressed())
+
+	for off := uint64(0); off < 10; off++ {
+		p, codec, err := l.ReadRaw(off)
+		require.NoError(t, err)
+		// the sealed segments hand back their records compressed, the active one as they are
+		if s, _, _ := l.segment(off); s != l.activeSegment {
+			require.Equal(t, CodecFlate, codec)
+			require.Less(t, len(p), 100)
+		} else {
+			require.Equal(t, CodecNone, codec)
+		}
+		record, err := DecodeRaw(p, codec)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, value(off), record.Value)
+	}
+
+	require.NoError(t, l.Delete(3))
+	_, _, err = l.ReadRaw(3)
+	require.Equal(t, ErrRecordDeleted, err)
+	_, _, err = l.ReadRaw(10)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = DecodeRaw(nil, CodecFlate+1)
+	require.Error(t, err)
+}
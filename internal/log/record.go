@@ -0,0 +1,67 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+var ErrBadRecord = errors.New("log: bad record")
+
+/*
+RecordOption sets a field of a record NewRecord builds.
+*/
+type RecordOption func(*api.Record) error
+
+/*
+NewRecord builds a record of value ready to append. Its offset is left unset for Append to assign and, unless
+WithTimestamp sets one, so is its timestamp, which the log stamps from its clock. Options that would build a record
+the log can't use fail with ErrBadRecord.
+*/
+func NewRecord(value []byte, opts ...RecordOption) (*api.Record, error) {
+	record := &api.Record{Value: value}
+	for _, opt := range opts {
+		if err := opt(record); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+/*
+WithTimestamp sets the record's timestamp instead of leaving it to the log's clock.
+*/
+func WithTimestamp(t time.Time) RecordOption {
+	return func(record *api.Record) error {
+		if t.UnixNano() <= 0 {
+			return fmt.Errorf("%w: timestamp %v isn't after the epoch", ErrBadRecord, t)
+		}
+		record.Timestamp = t.UnixNano()
+		return nil
+	}
+}
+
+/*
+WithHeader sets one of the record's headers.
+*/
+func WithHeader(name string, value []byte) RecordOption {
+	return func(record *api.Record) error {
+		if name == "" {
+			return fmt.Errorf("%w: empty header name", ErrBadRecord)
+		}
+		if record.Headers == nil {
+			record.Headers = make(map[string][]byte)
+		}
+		record.Headers[name] = value
+		return nil
+	}
+}
+
+/*
+WithKey sets the record's KeyHeader for LookupLatest.
+*/
+func WithKey(key []byte) RecordOption {
+	return WithHeader(KeyHeader, key)
+}
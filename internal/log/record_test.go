@@ -0,0 +1,56 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "new-record-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 2)
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	at := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	record, err := NewRecord(
+		[]byte("hello world"),
+		WithTimestamp(at),
+		WithKey([]byte("k")),
+		WithHeader("trace", []byte("t")),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, at.UnixNano(), record.Timestamp)
+	require.Equal(t, map[string][]byte{KeyHeader: []byte("k"), "trace": []byte("t")}, record.Headers)
+	require.Equal(t, uint64(0), record.Offset)
+
+	off, err := l.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset), off)
+	read, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, at.UnixNano(), read.Timestamp)
+	require.Equal(t, record.Headers, read.Headers)
+
+	// without a timestamp the log's clock stamps it
+	record, err = NewRecord([]byte("hello world"))
+	require.NoError(t, err)
+	off, err = l.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+1), off)
+	require.Equal(t, c.Clock.Now().UnixNano(), record.Timestamp)
+
+	_, err = NewRecord(nil, WithHeader("", nil))
+	require.True(t, errors.Is(err, ErrBadRecord))
+	_, err = NewRecord(nil, WithTimestamp(time.Unix(0, 0)))
+	require.True(t, errors.Is(err, ErrBadRecord))
+}
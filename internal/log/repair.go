@@ -0,0 +1,290 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrUnrecoverable = errors.New("log: unrecoverable corruption")
+
+/*
+RepairReport summarizes what Repair fixed. Segments are identified by their base offsets.
+*/
+type RepairReport struct {
+	Segments       int
+	TornSegments   []uint64
+	TruncatedBytes uint64
+	RebuiltIndexes []uint64
+}
+
+/*
+Repair fixes the damage a crash can leave behind in each segment: it truncates torn writes off the end of stores,
+rebuilds indexes that don't match their store, and resets the segments' sizes and next offsets to match. Corruption
+that isn't at the tail of a store can't be repaired without losing records, so Repair stops with ErrUnrecoverable.
+*/
+func (l *Log) Repair() (RepairReport, error) {
+	l.lock()
+	defer l.unlock()
+	if l.closed {
+		return RepairReport{}, ErrLogClosed
+	}
+	defer l.recount()
+	var report RepairReport
+	for _, s := range l.segments {
+		report.Segments++
+		truncated, err := s.store.truncateTorn()
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", s.store.Name(), err)
+		}
+		if truncated > 0 {
+			report.TornSegments = append(report.TornSegments, s.baseOffset)
+			report.TruncatedBytes += truncated
+		}
+		rebuilt, err := s.rebuildIndex()
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", s.index.Name(), err)
+		}
+		if rebuilt {
+			report.RebuiltIndexes = append(report.RebuiltIndexes, s.baseOffset)
+		}
+	}
+	return report, nil
+}
+
+/*
+records returns the positions of the records in the store, in order, failing with ErrTornRecord if the last one runs
+past the end of the store.
+*/
+func (s *store) records() ([]uint64, error) {
+	var positions []uint64
+	for pos := s.start(); pos < s.size; {
+		if pos+lenWidth > s.size {
+			return nil, fmt.Errorf("%w: length prefix at %d", ErrTornRecord, pos)
+		}
+		n, err := s.ReadLen(pos)
+		if err != nil {
+			return nil, err
+		}
+		next := pos + s.width(n)
+		if next > s.size || next < pos {
+			return nil, fmt.Errorf("%w: record at %d", ErrTornRecord, pos)
+		}
+		positions = append(positions, pos)
+		pos = next
+	}
+	return positions, nil
+}
+
+/*
+start returns the position of the store's first record.
+*/
+func (s *store) start() uint64 {
+	if s.version == FormatV2 {
+		return headerWidth
+	}
+	return 0
+}
+
+/*
+truncateTorn walks the store's records and truncates the file at the first record that was only partly written,
+returning how many bytes were cut. A record that fails its checksum is treated as torn only if it's the last one.
+*/
+func (s *store) truncateTorn() (uint64, error) {
+	pos := s.start()
+	for pos < s.size {
+		if pos+lenWidth > s.size {
+			break
+		}
+		n, err := s.ReadLen(pos)
+		if err != nil {
+			return 0, err
+		}
+		next := pos + s.width(n)
+		if next > s.size || next < pos {
+			break
+		}
+		if _, err = s.Read(pos); err != nil {
+			if next == s.size {
+				break
+			}
+			return 0, fmt.Errorf("%w: record at %d: %v", ErrUnrecoverable, pos, err)
+		}
+		pos = next
+	}
+	if pos >= s.size {
+		return 0, nil
+	}
+	truncated := s.size - pos
+	if err := s.truncate(pos); err != nil {
+		return 0, err
+	}
+	// the count from when the store was opened covered the records truncated away
+	payload, err := s.countPayload()
+	if err != nil {
+		return 0, err
+	}
+	s.payload = payload
+	return truncated, nil
+}
+
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.rollback(size)
+}
+
+/*
+rebuildIndex checks the index against the records in the store and rewrites it if they don't match, then resets the
+segment's next offset. Each record carries its own offset so we can rebuild indexes with gaps from defragmenting.
+Tombstones in the old index are kept.
+*/
+func (s *segment) rebuildIndex() (bool, error) {
+	positions, err := s.store.records()
+	if err != nil {
+		return false, err
+	}
+	entries, err := readAll(s.index)
+	if err != nil {
+		return false, err
+	}
+	tombstoned := make(map[uint32]bool)
+	for _, e := range entries {
+		if e.Pos == tombstone {
+			tombstoned[e.Off] = true
+		}
+	}
+
+	var want []IndexEntry
+	next := s.baseOffset
+	for _, pos := range positions {
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return false, err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return false, fmt.Errorf("%w: record at %d: %v", ErrUnrecoverable, pos, err)
+		}
+		if record.Offset < next {
+			return false, fmt.Errorf("%w: record at %d has offset %d", ErrUnrecoverable, pos, record.Offset)
+		}
+		rel := uint32(record.Offset - s.baseOffset)
+		next = record.Offset + 1
+		if uint64(rel)%s.indexEvery() != 0 {
+			continue
+		}
+		if tombstoned[rel] {
+			pos = tombstone
+		}
+		want = append(want, IndexEntry{Off: rel, Pos: pos})
+	}
+	// a deleted last record only survives defragmenting as a tombstone
+	if n := len(entries); n > 0 {
+		last := entries[n-1]
+		if last.Pos == tombstone && s.baseOffset+uint64(last.Off) >= next {
+			want = append(want, last)
+			next = s.baseOffset + uint64(last.Off) + 1
+		}
+	}
+
+	matches := len(want) == len(entries)
+	for i := 0; matches && i < len(want); i++ {
+		matches = want[i] == entries[i]
+	}
+	s.nextOffset = next
+	if matches {
+		return false, nil
+	}
+	resetter, ok := s.index.(interface{ Reset() error })
+	if !ok {
+		return false, ErrIndexUnsupported
+	}
+	if err = resetter.Reset(); err != nil {
+		return false, err
+	}
+	for _, e := range want {
+		if err := s.index.Write(e.Off, e.Pos); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+/*
+RecoveryReport lists the segments Config.QuarantineCorrupt set aside when the log was opened, by base offset, with
+why they failed. Their offsets read as out of range.
+*/
+type RecoveryReport struct {
+	Quarantined []QuarantinedSegment
+}
+
+type QuarantinedSegment struct {
+	BaseOffset uint64
+	Err        error
+}
+
+/*
+Recovery returns what was quarantined when the log was opened.
+*/
+func (l *Log) Recovery() RecoveryReport {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recovery
+}
+
+/*
+openOrQuarantine opens and verifies a sealed segment, quarantining it if either fails. The active segment is never
+quarantined since we don't know how far its offsets got and would hand them out again, Repair it instead.
+*/
+func (l *Log) openOrQuarantine(baseOffset uint64) error {
+	s, err := newSegment(l.Dir, baseOffset, l.Config)
+	if err == nil {
+		if err = s.verify(); err == nil {
+			l.addSegment(s)
+			return nil
+		}
+		s.Close()
+	}
+	for _, ext := range []string{".store", ".index"} {
+		name := path.Join(l.Dir, fmt.Sprintf("%d%s", baseOffset, ext))
+		if renameErr := l.Config.fileSystem().Rename(name, name+quarantineSuffix); renameErr != nil && !os.IsNotExist(renameErr) {
+			return renameErr
+		}
+	}
+	l.recovery.Quarantined = append(l.recovery.Quarantined, QuarantinedSegment{
+		BaseOffset: l.offset(baseOffset),
+		Err:        err,
+	})
+	return nil
+}
+
+/*
+verify reads every record in the store, which checks their checksums in stores that have them, and makes sure they
+decode and their offsets belong to the segment in order.
+*/
+func (s *segment) verify() error {
+	positions, err := s.store.records()
+	if err != nil {
+		return err
+	}
+	next := s.baseOffset
+	for _, pos := range positions {
+		record, err := s.readAt(pos)
+		if err != nil {
+			return fmt.Errorf("record at %d: %w", pos, err)
+		}
+		if record.Offset < next || record.Offset >= s.nextOffset {
+			return fmt.Errorf("record at %d has offset %d", pos, record.Offset)
+		}
+		next = record.Offset + 1
+	}
+	return nil
+}
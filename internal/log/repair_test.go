@@ -0,0 +1,179 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// a torn write at the end of the first store
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, lenWidth+3)
+	enc.PutUint64(torn, 100)
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	// an index missing entries
+	require.NoError(t, os.Truncate(path.Join(dir, "3.index"), int64(entWidth)))
+	// an index that was never truncated because the log crashed
+	require.NoError(t, os.Truncate(path.Join(dir, "6.index"), int64(c.Segment.MaxIndexBytes)))
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	report, err := l.Repair()
+	require.NoError(t, err)
+	require.Equal(t, RepairReport{
+		Segments:       3,
+		TornSegments:   []uint64{0},
+		TruncatedBytes: uint64(len(torn)),
+		RebuiltIndexes: []uint64{3, 6},
+	}, report)
+
+	check := func(l *Log, want uint64) {
+		for i := uint64(0); i <= want; i++ {
+			record, err := l.Read(i)
+			require.NoError(t, err)
+			require.Equal(t, i, record.Offset)
+			require.Equal(t, fmt.Sprintf("record-%d", i), string(record.Value))
+		}
+		highest, err := l.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, want, highest)
+	}
+	check(l, 7)
+	off, err := l.Append(&api.Record{Value: []byte("record-8")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+
+	// a second pass has nothing to do, the append filled the last segment so the log has rolled
+	report, err = l.Repair()
+	require.NoError(t, err)
+	require.Equal(t, RepairReport{Segments: 4}, report)
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	check(l, 8)
+	require.NoError(t, l.Close())
+}
+
+func TestLogRepairUnrecoverable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-repair-unrecoverable-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Store.FormatVersion = FormatV2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// corrupt the first record's payload, which isn't a torn tail
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("J"), headerWidth+lenWidth+crcWidth+2)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Repair()
+	require.True(t, errors.Is(err, ErrUnrecoverable))
+}
+
+func TestLogQuarantineCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-quarantine-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Store.FormatVersion = FormatV2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		if i%3 == 2 {
+			require.NoError(t, l.Roll())
+		}
+	}
+	require.NoError(t, l.Close())
+
+	// corrupt the middle segment's first record
+	f, err := os.OpenFile(path.Join(dir, "3.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("J"), headerWidth+lenWidth+crcWidth+2)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	// and the last sealed segment's first length prefix, so it claims far more bytes than the store holds
+	f, err = os.OpenFile(path.Join(dir, "6.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	huge := make([]byte, lenWidth)
+	enc.PutUint64(huge, 1<<62)
+	_, err = f.WriteAt(huge, headerWidth)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c.QuarantineCorrupt = true
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	report := l.Recovery()
+	require.Len(t, report.Quarantined, 2)
+	for i, base := range []uint64{3, 6} {
+		require.Equal(t, base, report.Quarantined[i].BaseOffset)
+		require.Error(t, report.Quarantined[i].Err)
+		for _, name := range []string{".store", ".index"} {
+			_, err = os.Stat(path.Join(dir, fmt.Sprintf("%d%s", base, name)+quarantineSuffix))
+			require.NoError(t, err)
+		}
+	}
+
+	for off := uint64(0); off < 9; off++ {
+		record, err := l.Read(off)
+		if off >= 3 {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+
+	// the quarantined files are left alone when the log is reopened
+	require.NoError(t, l.Close())
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, l.Recovery().Quarantined)
+	_, err = l.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
@@ -0,0 +1,165 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// rollOffset is where rollConfig's logs start. Offsets from here to 127 marshal as a single byte, so every
+// rollRecord has the same size as long as tests stay below that.
+const rollOffset = 16
+
+/*
+rollConfig returns a config whose segments roll on their store size after exactly n rollRecords. The clock is fixed so
+timestamps don't change the records' size.
+*/
+func rollConfig(t testing.TB, n int) Config {
+	t.Helper()
+	c := Config{}
+	c.Clock = &fakeClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	c.Segment.InitialOffset = rollOffset
+	c.Segment.MaxIndexBytes = 1024
+	record := rollRecord()
+	record.Offset = rollOffset
+	record.Timestamp = c.Clock.Now().UnixNano()
+	c.Segment.MaxStoreBytes = uint64(n) * (lenWidth + uint64(proto.Size(record)))
+	require.True(t, c.Segment.MaxIndexBytes > uint64(n)*entWidth)
+	return c
+}
+
+func rollRecord() *api.Record {
+	return &api.Record{Value: []byte("hello world")}
+}
+
+/*
+appendRolls appends n rollRecords to the log.
+*/
+func appendRolls(t testing.TB, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := l.Append(rollRecord())
+		require.NoError(t, err)
+	}
+}
+
+func requireSegments(t testing.TB, l *Log, n int) {
+	t.Helper()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	require.Len(t, l.segments, n, "segment count")
+}
+
+func requireActiveBase(t testing.TB, l *Log, base uint64) {
+	t.Helper()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	require.Equal(t, base, l.activeSegment.baseOffset, "active segment base offset")
+}
+
+func TestRollConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 3))
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendRolls(t, l, 2)
+	requireSegments(t, l, 1)
+	appendRolls(t, l, 1)
+	requireSegments(t, l, 2)
+	requireActiveBase(t, l, rollOffset+3)
+	appendRolls(t, l, 6)
+	requireSegments(t, l, 4)
+	requireActiveBase(t, l, rollOffset+9)
+}
+
+func TestRollSegmentRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-router-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	var reasons []string
+	c.OnRoll = func(_, _ uint64, reason string) {
+		reasons = append(reasons, reason)
+	}
+	c.SegmentRouter = func(_ *api.Record, segments []SegmentInfo) (uint64, bool) {
+		return 0, true
+	}
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendRolls(t, l, 4)
+	requireSegments(t, l, 4)
+	requireActiveBase(t, l, rollOffset+3)
+	require.Equal(t, []string{RollRouted, RollRouted, RollRouted}, reasons)
+	for off := uint64(rollOffset); off < rollOffset+4; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+
+	// sealed segments can't be appended to
+	l.Config.SegmentRouter = func(_ *api.Record, segments []SegmentInfo) (uint64, bool) {
+		require.True(t, segments[0].Sealed)
+		require.False(t, segments[len(segments)-1].Sealed)
+		return segments[0].BaseOffset, false
+	}
+	_, err = l.Append(rollRecord())
+	require.Equal(t, ErrSegmentSealed, err)
+
+	// the active segment can
+	l.Config.SegmentRouter = func(_ *api.Record, segments []SegmentInfo) (uint64, bool) {
+		return segments[len(segments)-1].BaseOffset, false
+	}
+	appendRolls(t, l, 1)
+	requireSegments(t, l, 4)
+	requireActiveBase(t, l, rollOffset+3)
+}
+
+func TestRollTrimOnSeal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-trim-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	c.Segment.MaxStoreBytes *= 10
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.TrimOnSeal = true
+	// leave space past the last record as the segment is sealed, as if the file had been preallocated
+	c.Store.SyncPolicy = SyncOnRoll
+	c.Store.Syncer = func(f *os.File) error {
+		return f.Truncate(int64(c.Segment.MaxStoreBytes))
+	}
+	var reason string
+	c.OnRoll = func(_, _ uint64, r string) {
+		reason = r
+	}
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendRolls(t, l, 3)
+	requireSegments(t, l, 2)
+	require.Equal(t, RollIndexMaxed, reason)
+
+	sealed := l.segments[0]
+	fi, err := os.Stat(sealed.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(sealed.store.size), fi.Size())
+	require.Less(t, sealed.store.size, c.Segment.MaxStoreBytes)
+	for off := uint64(rollOffset); off < rollOffset+3; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, rollRecord().Value, record.Value)
+	}
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+var ErrSegmentEmpty = errors.New("log: segment has no live records")
+
+/*
+SeekTime returns the first offset whose record's timestamp is at or after t, for consumers reading a time range. It
+binary searches the segments by their newest record's timestamp and then the chosen segment's records, so it assumes
+timestamps mostly go up with offsets as they do with the log's clock or Config.MonotonicTimestamps. If every record is
+older than t it returns the log's next offset, where a consumer would only see records appended from now on.
+*/
+func (l *Log) SeekTime(t time.Time) (uint64, error) {
+	ts := t.UnixNano()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	var err error
+	i := sort.Search(len(l.segments), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var newest *api.Record
+		newest, _, err = l.segments[i].liveBefore(l.segments[i].nextOffset)
+		if err == io.EOF {
+			// nothing live to go by, so keep searching above it
+			err = nil
+			return false
+		}
+		return err != nil || newest.Timestamp >= ts
+	})
+	if err != nil {
+		return 0, err
+	}
+	for ; i < len(l.segments); i++ {
+		off, ok, err := l.segments[i].SeekTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return l.offset(off), nil
+		}
+	}
+	return l.offset(l.activeSegment.nextOffset), nil
+}
+
+/*
+SeekTime returns the first offset in the segment whose record's timestamp is at or after ts, reporting false if there
+isn't one.
+*/
+func (s *segment) SeekTime(ts int64) (uint64, bool, error) {
+	var err error
+	n := int(s.nextOffset - s.baseOffset)
+	i := sort.Search(n, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var record *api.Record
+		record, _, err = s.liveAfter(s.baseOffset + uint64(i))
+		if err == io.EOF {
+			err = nil
+			return true
+		}
+		return err != nil || record.Timestamp >= ts
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	record, off, err := s.liveAfter(s.baseOffset + uint64(i))
+	if err == io.EOF || (err == nil && record.Timestamp < ts) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return off, true, nil
+}
+
+/*
+liveAfter returns the first record at or after off that hasn't been deleted, and its offset, or io.EOF if there isn't
+one in the segment.
+*/
+func (s *segment) liveAfter(off uint64) (*api.Record, uint64, error) {
+	for ; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if err == ErrRecordDeleted {
+			continue
+		}
+		return record, off, err
+	}
+	return nil, 0, io.EOF
+}
+
+/*
+liveBefore returns the last record before off that hasn't been deleted, and its offset, or io.EOF if there isn't one in
+the segment.
+*/
+func (s *segment) liveBefore(off uint64) (*api.Record, uint64, error) {
+	for ; off > s.baseOffset; off-- {
+		record, err := s.Read(off - 1)
+		if err == ErrRecordDeleted {
+			continue
+		}
+		return record, off - 1, err
+	}
+	return nil, 0, io.EOF
+}
+
+/*
+First returns the segment's first record that hasn't been deleted, for tools indexing segments by their range of
+offsets or timestamps, or ErrSegmentEmpty if there isn't one.
+*/
+func (s *segment) First() (*api.Record, error) {
+	record, _, err := s.liveAfter(s.baseOffset)
+	if err == io.EOF {
+		return nil, ErrSegmentEmpty
+	}
+	return record, err
+}
+
+/*
+Last returns the segment's last record that hasn't been deleted, or ErrSegmentEmpty if there isn't one.
+*/
+func (s *segment) Last() (*api.Record, error) {
+	record, _, err := s.liveBefore(s.nextOffset)
+	if err == io.EOF {
+		return nil, ErrSegmentEmpty
+	}
+	return record, err
+}
@@ -0,0 +1,55 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSeekTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-seek-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := rollConfig(t, 3)
+	clock := c.Clock.(*fakeClock)
+	start := clock.now
+	l, err := newTestLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	// a record a second
+	for i := 0; i < 9; i++ {
+		appendRolls(t, l, 1)
+		clock.now = clock.now.Add(time.Second)
+	}
+	requireSegments(t, l, 4)
+	at := func(i int) time.Time {
+		return start.Add(time.Duration(i) * time.Second)
+	}
+
+	for _, tc := range []struct {
+		t    time.Time
+		want uint64
+	}{
+		{start.Add(-time.Hour), rollOffset},
+		{at(0), rollOffset},
+		{at(4), rollOffset + 4},
+		{at(4).Add(-time.Millisecond), rollOffset + 4},
+		{at(3), rollOffset + 3},
+		{at(8), rollOffset + 8},
+		{at(9), rollOffset + 9},
+	} {
+		off, err := l.SeekTime(tc.t)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, off, "%s", tc.t)
+	}
+
+	// deleted records are skipped
+	require.NoError(t, l.Delete(rollOffset+4))
+	off, err := l.SeekTime(at(4))
+	require.NoError(t, err)
+	require.Equal(t, uint64(rollOffset+5), off)
+}
@@ -1,24 +1,70 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 
 	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 
 )
 
 
+const (
+	// deletedSuffix is added to the names of segment files that have been truncated but not yet purged
+	deletedSuffix = ".deleted"
+	// tempSuffix and defragSuffix are added to the names of segment files while they're being created or rewritten
+	tempSuffix   = ".tmp"
+	defragSuffix = ".defrag"
+	// quarantineSuffix is added to the names of corrupt segment files set aside when the log was opened
+	quarantineSuffix = ".quarantine"
+)
+
+/*
+WriteOrder decides which half of an append a segment writes first, which decides what a crash between the two leaves
+behind. With StoreFirst the record can be in the store without its index entry; the index is what counts, so opening
+the segment ignores the record and nothing reads it until Repair rebuilds the index and keeps it, since it was written
+in full. With IndexFirst the index can point at a record that's missing from the store or torn; opening the segment
+drops that entry along with the torn bytes, so the next offset only ever counts appends that finished. Either way an
+append only returns once both halves are written.
+*/
+type WriteOrder uint8
+
+const (
+	StoreFirst WriteOrder = iota
+	IndexFirst
+)
+
+// headersField is the field number of api.Record's headers
+var headersField = (&api.Record{}).ProtoReflect().Descriptor().Fields().ByName("headers").Number()
+
+var (
+	ErrRecordDeleted    = errors.New("log: record deleted")
+	ErrSparseIndex      = errors.New("log: not supported with a sparse index")
+	ErrIndexUnsupported = errors.New("log: not supported by the index")
+	ErrReadOnly         = errors.New("log: segment is read-only")
+	ErrOffsetMismatch   = errors.New("log: record offset doesn't match the offset read")
+	ErrOffsetPreset     = errors.New("log: record offset preset to another offset than it would be appended at")
+)
+
 /*
 The segment wraps the index and store types to coordinate operations across the two.
 */
 type segment struct {
 	store *store
-	index *index
+	index Index
 	baseOffset, nextOffset uint64
 	config Config
+	// dirty counts the store bytes taken up by deleted records
+	dirty uint64
+	// keys filters the keys in a sealed segment once LookupLatest has built it
+	keys *keyFilter
+	// readOnly is set for segments opened with OpenSegmentReadOnly
+	readOnly bool
 }
 
 /*
@@ -28,23 +74,37 @@ If the index is empty, then the next record appended to the segment would be the
 be the segments base offset.
 */
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	return openSegment(dir, baseOffset, c, nil)
+}
+
+/*
+openSegment opens a segment like newSegment. Given its manifest entry, it takes the next offset, payload and dirty
+bytes from there instead of working them out from the segment's files.
+*/
+func openSegment(dir string, baseOffset uint64, c Config, known *manifestEntry) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config: c,
 	}
 	var err error
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+	storeName := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	if _, err = c.fileSystem().Stat(storeName); os.IsNotExist(err) {
+		if err = createSegmentFiles(dir, baseOffset, c); err != nil {
+			return nil, err
+		}
+	}
+	storeFile, err := c.fileSystem().OpenFile(
+		storeName,
+		c.storeOpenFlags(),
 		0644,
 	)
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.store, err = openStore(storeFile, c, known == nil); err != nil {
 		return nil, err
 	}
-	indexFile, err := os.OpenFile(
+	indexFile, err := c.fileSystem().OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE,
 		0644,
@@ -52,16 +112,163 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if err != nil {
 		return nil, err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
+	if s.index, err = openIndex(indexFile, c); err != nil {
+		return nil, err
+	}
+	if known != nil {
+		s.nextOffset, s.store.payload, s.dirty = known.nextOffset, known.payload, known.dirty
+		return s, nil
+	}
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+SegmentReader is a segment opened with OpenSegmentReadOnly. Offsets are the segment's own, starting at its base offset.
+*/
+type SegmentReader interface {
+	BaseOffset() uint64
+	NextOffset() uint64
+	Read(off uint64) (*api.Record, error)
+	ReadHeaders(off uint64) (map[string][]byte, error)
+	ReadRaw(off uint64) ([]byte, uint8, error)
+	Exists(off uint64) (bool, error)
+	First() (*api.Record, error)
+	Last() (*api.Record, error)
+	Dump(w io.Writer) error
+	IndexEntries() ([]IndexEntry, error)
+	Close() error
+}
+
+var _ SegmentReader = (*segment)(nil)
+
+/*
+OpenSegmentReadOnly opens a segment from the given store and index files for inspecting it outside of a log directory,
+say in forensic tools. Nothing is created or written to, so the index is always our memory-mapped one, mapped
+read-only, and anything that would change the segment fails with ErrReadOnly.
+*/
+func OpenSegmentReadOnly(storePath, indexPath string, baseOffset uint64, c Config) (SegmentReader, error) {
+	s := &segment{
+		baseOffset: baseOffset,
+		config:     c,
+		readOnly:   true,
+	}
+	storeFile, err := os.Open(storePath)
+	if err != nil {
+		return nil, err
+	}
+	// an empty file would get a header written if the config asks for a versioned format, and a preallocated one
+	// would be grown
+	c.Store.FormatVersion = FormatV1
+	c.Store.Preallocate = false
+	if s.store, err = newStore(storeFile, c); err != nil {
+		storeFile.Close()
+		return nil, err
+	}
+	indexFile, err := os.Open(indexPath)
+	if err != nil {
+		s.store.Close()
+		return nil, err
+	}
+	if s.index, err = newReadOnlyIndex(indexFile); err != nil {
+		indexFile.Close()
+		s.store.Close()
+		return nil, err
+	}
+	if err = s.load(); err != nil {
+		s.Close()
 		return nil, err
 	}
-	if off, _, err := s.index.Read(-1); err != nil {
+	return s, nil
+}
+
+func (s *segment) BaseOffset() uint64 { return s.baseOffset }
+
+func (s *segment) NextOffset() uint64 { return s.nextOffset }
+
+/*
+load works out the segment's next offset and dirty bytes from its opened store and index.
+*/
+func (s *segment) load() error {
+	baseOffset := s.baseOffset
+	if off, pos, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
+	} else if s.indexEvery() > 1 {
+		// records after the last indexed one aren't in the index, so count them from the store
+		n, err := s.scan(pos, s.store.size)
+		if err != nil {
+			return err
+		}
+		if n > s.indexEvery() {
+			// a store first append crashed before indexing its record, which opening ignores
+			n = s.indexEvery()
+		}
+		s.nextOffset = baseOffset + uint64(off) + n
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
-	return s, nil
+	if s.config.WriteOrder == IndexFirst && !s.readOnly {
+		if err := s.dropDangling(); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.dirty, err = s.countDirty()
+	return err
+}
+
+/*
+dropDangling undoes an IndexFirst append that crashed before its record was written to the store in full, leaving the
+index's last entry pointing at the end of the store or at a torn record.
+*/
+func (s *segment) dropDangling() error {
+	off, pos, err := s.index.Read(-1)
+	if err != nil || pos == tombstone {
+		// an empty index
+		return nil
+	}
+	if pos+lenWidth <= s.store.size {
+		n, err := s.store.ReadLen(pos)
+		if err != nil {
+			return err
+		}
+		if end := pos + s.store.width(n); end >= pos && end <= s.store.size {
+			return nil
+		}
+	}
+	// a sparse index doesn't count the dangling record in the next offset if none of it made it to the store
+	s.nextOffset = s.baseOffset + uint64(off) + 1
+	return s.ResetTo(s.baseOffset + uint64(off))
+}
 
+/*
+createSegmentFiles creates a new segment's index and store as temp files and renames them into place once they're
+complete, so a crash can't leave a store behind without its header. The index goes first since the store is what marks
+a segment as existing, and an empty index left on its own is harmless.
+*/
+func createSegmentFiles(dir string, baseOffset uint64, c Config) error {
+	for _, ext := range []string{".index", ".store"} {
+		name := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+		f, err := c.fileSystem().OpenFile(name+tempSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if ext == ".store" && c.Store.FormatVersion > FormatV1 {
+			if _, err = f.Write(storeHeader(c.Store.FormatVersion, CodecNone, c.storeFlags())); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		if err = c.fileSystem().Rename(name+tempSuffix, name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 /*
@@ -70,33 +277,105 @@ the offset to the API response. The segment appends a record in a two step proce
 and then adds an index entry.
 */
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	offset, _, err = s.AppendUsing(record, nil)
+	return offset, err
+}
+
+/*
+AppendUsing appends the record like Append but marshals it into buf, returning the possibly grown buffer so tight
+loops can reuse it across appends instead of allocating for every record.
+*/
+func (s *segment) AppendUsing(record *api.Record, buf []byte) (uint64, []byte, error) {
+	if s.readOnly {
+		return 0, buf, ErrReadOnly
+	}
 	cursor := s.nextOffset
+	if want := s.config.offset(cursor); s.config.StrictOffsets && record.Offset != 0 && record.Offset != want {
+		return 0, buf, fmt.Errorf("%w: preset %d, appending at %d", ErrOffsetPreset, record.Offset, want)
+	}
 	record.Offset = cursor
-	p, err := proto.Marshal(record)
+	s.stamp(record)
+	p, err := proto.MarshalOptions{}.MarshalAppend(buf[:0], record)
 	if err != nil {
-		return 0, err
+		return 0, buf, err
+	}
+	// index offsets are relative to base offset
+	rel := s.nextOffset - uint64(s.baseOffset)
+	indexed := rel%s.indexEvery() == 0
+	if indexed && s.config.WriteOrder == IndexFirst {
+		if err = s.index.Write(uint32(rel), s.store.size); err != nil {
+			return 0, p, err
+		}
+		if _, _, err = s.store.Append(p); err != nil {
+			// take the entry back out so the index doesn't point past the store
+			s.nextOffset++
+			if rerr := s.ResetTo(cursor); rerr != nil {
+				return 0, p, rerr
+			}
+			return 0, p, err
+		}
+		s.nextOffset++
+		return cursor, p, nil
 	}
 	_, pos, err := s.store.Append(p)
-	if err = s.index.Write(
-		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+	if err != nil {
+		return 0, p, err
+	}
+	if indexed {
+		if err = s.index.Write(uint32(rel), pos); err != nil {
+			return 0, p, err
+		}
 	}
 	s.nextOffset++
-	return cursor, nil
+	return cursor, p, nil
 
 }
 
+/*
+stamp sets the record's timestamp from the clock unless the producer gave it one.
+*/
+func (s *segment) stamp(record *api.Record) {
+	if record.Timestamp == 0 {
+		record.Timestamp = s.config.clock().Now().UnixNano()
+	}
+}
+
 /*
 Read
 */
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	pos, err := s.position(off)
 	if err != nil {
 		return nil, err
 	}
+	record, err := s.readAt(pos)
+	if err != nil {
+		return nil, s.corrupted(off, err)
+	}
+	if s.config.Segment.VerifyReadOffset && record.Offset != off {
+		err = fmt.Errorf("%w: read %d at %d, got %d", ErrOffsetMismatch, off, pos, record.Offset)
+		return nil, s.corrupted(off, err)
+	}
+	return record, nil
+}
+
+/*
+corrupted reports err to Config.OnCorruption if it says the record at the local offset is corrupt, and returns it.
+*/
+func (s *segment) corrupted(off uint64, err error) error {
+	if s.config.OnCorruption == nil {
+		return err
+	}
+	if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrOffsetMismatch) {
+		s.config.OnCorruption(s.config.offset(s.baseOffset), s.config.offset(off), err)
+	}
+	return err
+}
+
+/*
+readAt reads the record stored at the given store position.
+*/
+func (s *segment) readAt(pos uint64) (*api.Record, error) {
 	p, err := s.store.Read(pos)
 	if err != nil {
 		return nil, err
@@ -106,24 +385,584 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+/*
+ReadHeaders returns the headers of the record at the given offset. We walk the marshaled record's fields and only
+decode the headers, skipping over the value rather than copying it.
+*/
+func (s *segment) ReadHeaders(off uint64) (map[string][]byte, error) {
+	pos, err := s.position(off)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string][]byte)
+	for len(p) > 0 {
+		num, typ, n := protowire.ConsumeTag(p)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		p = p[n:]
+		if num != headersField || typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, p); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			p = p[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(p)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		p = p[n:]
+		// map entries are messages with the key in field 1 and the value in field 2
+		var key string
+		var value []byte
+		for len(entry) > 0 {
+			num, typ, n := protowire.ConsumeTag(entry)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			entry = entry[n:]
+			if typ != protowire.BytesType {
+				if n = protowire.ConsumeFieldValue(num, typ, entry); n < 0 {
+					return nil, protowire.ParseError(n)
+				}
+				entry = entry[n:]
+				continue
+			}
+			b, n := protowire.ConsumeBytes(entry)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			entry = entry[n:]
+			switch num {
+			case 1:
+				key = string(b)
+			case 2:
+				value = b
+			}
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+/*
+RecordSize returns the size in bytes of the marshaled record at the given offset without reading the record itself.
+*/
+func (s *segment) RecordSize(off uint64) (uint64, error) {
+	pos, err := s.position(off)
+	if err != nil {
+		return 0, err
+	}
+	return s.store.ReadLen(pos)
+}
+
+/*
+position returns the store position of the record at the given offset. With a sparse index we look up the nearest
+indexed record at or before the offset and then step forward through the store's length prefixes.
+*/
+func (s *segment) position(off uint64) (uint64, error) {
+	if off < s.baseOffset || off >= s.nextOffset {
+		return 0, io.EOF
+	}
+	rel := off - s.baseOffset
+	every := s.indexEvery()
+	if every == 1 {
+		_, pos, err := s.entry(rel)
+		if err == io.EOF {
+			// compacted out of the index
+			return 0, ErrRecordDeleted
+		}
+		if err == nil && pos == tombstone {
+			return 0, ErrRecordDeleted
+		}
+		return pos, err
+	}
+	indexed, pos, err := s.index.Read(int64(rel / every))
+	if err != nil {
+		return 0, err
+	}
+	for i := uint64(indexed); i < rel; i++ {
+		n, err := s.store.ReadLen(pos)
+		if err != nil {
+			return 0, err
+		}
+		pos += s.store.width(n)
+	}
+	return pos, nil
+}
+
+/*
+Exists reports whether the segment holds a live record at the given offset. Sparse indexes can't be compacted or
+tombstoned, so every offset in their range exists.
+*/
+func (s *segment) Exists(off uint64) (bool, error) {
+	if off < s.baseOffset || off >= s.nextOffset {
+		return false, nil
+	}
+	if s.indexEvery() > 1 {
+		return true, nil
+	}
+	_, pos, err := s.entry(off - s.baseOffset)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return pos != tombstone, nil
+}
+
+/*
+entry returns the number and position of the index entry for the given relative offset in a dense index. Entry n
+holds offset n until deleted records are compacted out of the index, after which we fall back to searching it.
+*/
+func (s *segment) entry(rel uint64) (int64, uint64, error) {
+	out, pos, err := s.index.Read(int64(rel))
+	if err == nil && uint64(out) == rel {
+		return int64(rel), pos, nil
+	}
+	return s.index.Search(uint32(rel))
+}
+
+/*
+Delete tombstones the record at the given offset. Its bytes stay in the store until the segment is defragmented.
+*/
+func (s *segment) Delete(off uint64) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.indexEvery() > 1 {
+		return ErrSparseIndex
+	}
+	if off < s.baseOffset || off >= s.nextOffset {
+		return io.EOF
+	}
+	setter, ok := s.index.(interface{ SetPos(in int64, pos uint64) error })
+	if !ok {
+		return ErrIndexUnsupported
+	}
+	in, pos, err := s.entry(off - s.baseOffset)
+	if err != nil || pos == tombstone {
+		return err
+	}
+	n, err := s.store.ReadLen(pos)
+	if err != nil {
+		return err
+	}
+	if err = setter.SetPos(in, tombstone); err != nil {
+		return err
+	}
+	s.dirty += s.store.width(n)
+	return nil
+}
+
+/*
+countDirty works out how many store bytes belong to deleted records. Tombstones don't keep their record's position,
+so if there are any we add up the live records and count everything else as dirty.
+*/
+func (s *segment) countDirty() (uint64, error) {
+	if s.indexEvery() > 1 {
+		return 0, nil
+	}
+	entries, err := readAll(s.index)
+	if err != nil {
+		return 0, err
+	}
+	deleted := false
+	for _, e := range entries {
+		deleted = deleted || e.Pos == tombstone
+	}
+	if !deleted {
+		return 0, nil
+	}
+	var live uint64
+	for _, e := range entries {
+		if e.Pos == tombstone {
+			continue
+		}
+		n, err := s.store.ReadLen(e.Pos)
+		if err != nil {
+			return 0, err
+		}
+		live += s.store.width(n)
+	}
+	return s.store.size - s.store.start() - live, nil
+}
+
+/*
+DirtyRatio returns the fraction of the segment's record bytes that belong to deleted records.
+*/
+func (s *segment) DirtyRatio() float64 {
+	total := s.store.size - s.store.start()
+	if total == 0 {
+		return 0
+	}
+	return float64(s.dirty) / float64(total)
+}
+
+/*
+Defragment rewrites the segment's store and index without its deleted records. Surviving records keep their offsets,
+the index just no longer has entries for the deleted ones. If the last record was deleted we keep its tombstone so
+the segment's next offset survives reopening.
+*/
+func (s *segment) Defragment() error {
+	return s.rewrite(s.rewriteConfig(), nil)
+}
+
+/*
+Compress rewrites the segment with its records compressed, which like Defragment drops deleted records. Compressed
+stores need a header to record the codec in, so the copy is always v2. It's only for sealed segments since the copy
+can't be appended to unless the config writes v2 with the same codec, which it never does. With
+Config.CompressMinBytes only the records over it are compressed.
+*/
+func (s *segment) Compress() error {
+	c := s.config
+	c.Store.FormatVersion = FormatV2
+	c.Store.codec = CodecFlate
+	if c.CompressMinBytes > 0 {
+		c.Store.codec = CodecFlateSelective
+	}
+	return s.rewrite(c, nil)
+}
+
+/*
+rewriteConfig returns the config to rewrite the segment with, which keeps compressed segments compressed.
+*/
+func (s *segment) rewriteConfig() Config {
+	c := s.config
+	if s.Compressed() {
+		c.Store.FormatVersion = s.store.version
+		c.Store.codec = s.store.codec
+	}
+	return c
+}
+
+/*
+Compressed reports whether the segment's records are compressed.
+*/
+func (s *segment) Compressed() bool {
+	return s.store.codec != CodecNone
+}
+
+/*
+Redact rewrites the segment with the records at the given relative offsets replaced by a record with the same offset
+and timestamp whose value is replacement, or zeros the length of the old value if replacement is nil. Headers are
+dropped along with the value since they can hold personal data too. Like Defragment this drops deleted records.
+*/
+func (s *segment) Redact(rels map[uint32]bool, replacement []byte) error {
+	return s.rewrite(s.rewriteConfig(), func(rel uint32, p []byte) ([]byte, error) {
+		if !rels[rel] {
+			return p, nil
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return nil, err
+		}
+		value := replacement
+		if value == nil {
+			value = make([]byte, len(record.Value))
+		}
+		return proto.Marshal(&api.Record{Offset: record.Offset, Timestamp: record.Timestamp, Value: value})
+	})
+}
+
+/*
+rewrite copies the segment's live records into new store and index files created with c, passing each through
+transform if it's set, and swaps them in.
+*/
+func (s *segment) rewrite(c Config, transform func(rel uint32, p []byte) ([]byte, error)) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.indexEvery() > 1 {
+		return ErrSparseIndex
+	}
+	dir := path.Dir(s.store.Name())
+	storeName, indexName := s.store.Name(), s.index.Name()
+	store, index, err := createDefragFiles(dir, s.baseOffset, c)
+	if err != nil {
+		return err
+	}
+	// until the new files are swapped in, failing closes and removes them, leaving the segment's own files as they were
+	open, swapping := true, false
+	defer func() {
+		if swapping {
+			return
+		}
+		if open {
+			closeDefragFiles(store, index)
+		}
+		s.config.fileSystem().Remove(storeName + defragSuffix)
+		s.config.fileSystem().Remove(indexName + defragSuffix)
+	}()
+	entries, err := readAll(s.index)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		out, pos := e.Off, e.Pos
+		if pos == tombstone {
+			if i == len(entries)-1 {
+				if err = index.Write(out, tombstone); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return err
+		}
+		if transform != nil {
+			if p, err = transform(out, p); err != nil {
+				return err
+			}
+		}
+		if _, pos, err = store.Append(p); err != nil {
+			return err
+		}
+		if err = index.Write(out, pos); err != nil {
+			return err
+		}
+	}
+	open = false
+	if err = closeDefragFiles(store, index); err != nil {
+		return err
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	if err = s.config.fileSystem().Rename(storeName+defragSuffix, storeName); err != nil {
+		return err
+	}
+	swapping = true
+	if err = s.config.fileSystem().Rename(indexName+defragSuffix, indexName); err != nil {
+		return err
+	}
+	defragmented, err := newSegment(dir, s.baseOffset, s.config)
+	if err != nil {
+		return err
+	}
+	*s = *defragmented
+	return nil
+}
+
+/*
+ResetTo truncates the segment so that off is the next offset appended, dropping the record at off and every record
+after it from the store and index. With a dense index a deleted record has no position, so we cut the store at the end
+of the last live record before off instead.
+*/
+func (s *segment) ResetTo(off uint64) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if off < s.baseOffset || off > s.nextOffset {
+		return io.EOF
+	}
+	if off == s.nextOffset {
+		return nil
+	}
+	rel := uint32(off - s.baseOffset)
+	entries, err := readAll(s.index)
+	if err != nil {
+		return err
+	}
+	cut := s.store.start()
+	if s.indexEvery() > 1 {
+		if cut, err = s.position(off); err != nil {
+			return err
+		}
+	}
+	var kept []IndexEntry
+	for _, e := range entries {
+		if e.Off >= rel {
+			break
+		}
+		kept = append(kept, e)
+		if e.Pos == tombstone || s.indexEvery() > 1 {
+			continue
+		}
+		n, err := s.store.ReadLen(e.Pos)
+		if err != nil {
+			return err
+		}
+		cut = e.Pos + s.store.width(n)
+	}
+	resetter, ok := s.index.(interface{ Reset() error })
+	if !ok {
+		return ErrIndexUnsupported
+	}
+	if err = resetter.Reset(); err != nil {
+		return err
+	}
+	for _, e := range kept {
+		if err = s.index.Write(e.Off, e.Pos); err != nil {
+			return err
+		}
+	}
+	if err = s.store.truncate(cut); err != nil {
+		return err
+	}
+	if s.store.payload, err = s.store.countPayload(); err != nil {
+		return err
+	}
+	s.nextOffset = off
+	s.dirty, err = s.countDirty()
+	return err
+}
+
+/*
+CompactIndex closes and reopens the index, which truncates its file to the entries in use and then maps it again at
+MaxIndexBytes, so the index's size is read back from the file rather than carried over from before a ResetTo.
+*/
+func (s *segment) CompactIndex() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	name := s.index.Name()
+	if err := s.index.Close(); err != nil {
+		return err
+	}
+	f, err := s.config.fileSystem().OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.index, err = openIndex(f, s.config)
+	return err
+}
+
+/*
+scan counts the records in the store between the from and to positions.
+*/
+func (s *segment) scan(from, to uint64) (uint64, error) {
+	var n uint64
+	for pos := from; pos < to; n++ {
+		size, err := s.store.ReadLen(pos)
+		if err != nil {
+			return 0, err
+		}
+		pos += s.store.width(size)
+	}
+	return n, nil
+}
+
+func (s *segment) indexEvery() uint64 {
+	if s.config.Segment.IndexEvery == 0 {
+		return 1
+	}
+	return s.config.Segment.IndexEvery
+}
+
 /*
 IsMaxed returns whether the segment has reached its max size
 If you wrote a small number of long logs then you'd hit the segment bytes limit; if you wrote a lot of small logs,
 then you'd hit the index bytes limit.
 */
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.maxedBy() != ""
+}
+
+/*
+maxedBy returns the roll reason for whichever limit the segment has reached, or an empty string if it has room.
+*/
+func (s *segment) maxedBy() string {
+	switch {
+	case s.store.size >= s.config.Segment.MaxStoreBytes:
+		return RollStoreMaxed
+	case s.index.Size() >= s.config.Segment.MaxIndexBytes:
+		return RollIndexMaxed
+	}
+	return ""
+}
+
+/*
+Copy writes the segment's store and index files into dir under the same names, on the segment's file system.
+*/
+func (s *segment) Copy(dir string) error {
+	fs := s.config.fileSystem()
+	storeFile, err := fs.OpenFile(path.Join(dir, path.Base(s.store.Name())), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	if err = s.store.copyTo(storeFile); err != nil {
+		return err
+	}
+	indexFile, err := fs.OpenFile(path.Join(dir, path.Base(s.index.Name())), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	entries, err := readAll(s.index)
+	if err != nil {
+		return err
+	}
+	if err = writeEntries(indexFile, entries); err != nil {
+		return err
+	}
+	if err = storeFile.Sync(); err != nil {
+		return err
+	}
+	return indexFile.Sync()
+}
+
+/*
+IndexEntries returns the segment's index entries for diagnosing index corruption and migrating indexes. Indexes other
+than ours are read entry by entry.
+*/
+func (s *segment) IndexEntries() ([]IndexEntry, error) {
+	if idx, ok := s.index.(*index); ok {
+		return idx.Entries()
+	}
+	return readAll(s.index)
+}
+
+/*
+Sync commits the segment's store and index to stable storage.
+*/
+func (s *segment) Sync() error {
+	if err := s.store.sync(); err != nil {
+		return err
+	}
+	if syncer, ok := s.index.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+/*
+SoftRemove closes the segment and renames its files with the deleted suffix, leaving them for Log.PurgeDeleted to
+unlink. Renaming keeps the files' old modification times, so we reset them to mark when they were deleted.
+*/
+func (s *segment) SoftRemove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	now := s.config.clock().Now()
+	for _, name := range []string{s.index.Name(), s.store.Name()} {
+		if err := s.config.fileSystem().Rename(name, name+deletedSuffix); err != nil {
+			return err
+		}
+		if err := s.config.fileSystem().Chtimes(name+deletedSuffix, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := s.config.fileSystem().Remove(s.index.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.config.fileSystem().Remove(s.store.Name()); err != nil {
 		return err
 	}
 	return nil
@@ -1,12 +1,17 @@
 package log
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"github.com/stretchr/testify/require"
 	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -33,6 +38,10 @@ func TestSegment(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, want.Value, got.Value)
 
+		size, err := s.RecordSize(off)
+		require.NoError(t, err)
+		require.Equal(t, uint64(proto.Size(got)), size)
+
 	}
 
 	_, err = s.Append(want)
@@ -55,3 +64,504 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-sparse-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexEvery = 3
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	var values [][]byte
+	for i := 0; i < 10; i++ {
+		value := []byte(fmt.Sprintf("record-%d", i))
+		values = append(values, value)
+		off, err := s.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+		require.Equal(t, uint64(16+i), off)
+	}
+	// only offsets 0, 3, 6 and 9 relative to the base are indexed
+	require.Equal(t, 4*entWidth, s.index.Size())
+
+	check := func(s *segment) {
+		for i, want := range values {
+			got, err := s.Read(uint64(16 + i))
+			require.NoError(t, err)
+			require.Equal(t, want, got.Value)
+			require.Equal(t, uint64(16+i), got.Offset)
+		}
+		_, err := s.Read(uint64(16 + len(values)))
+		require.Equal(t, io.EOF, err)
+	}
+	check(s)
+
+	// the segment should rebuild its next offset from the store's unindexed tail
+	_, err = s.Append(&api.Record{Value: []byte("record-10")})
+	require.NoError(t, err)
+	values = append(values, []byte("record-10"))
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16+len(values)), s.nextOffset)
+	check(s)
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentDefragment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-defragment-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+	// delete the odd offsets, including the last record
+	for off := uint64(17); off < 26; off += 2 {
+		require.NoError(t, s.Delete(off))
+		_, err = s.Read(off)
+		require.Equal(t, ErrRecordDeleted, err)
+	}
+	indexSize, storeSize := s.index.Size(), s.store.size
+
+	require.NoError(t, s.Defragment())
+	require.True(t, s.index.Size() < indexSize)
+	require.True(t, s.store.size < storeSize)
+	// five survivors plus the last record's tombstone
+	require.Equal(t, 6*entWidth, s.index.Size())
+
+	check := func(s *segment) {
+		require.Equal(t, uint64(26), s.nextOffset)
+		for i := 0; i < 10; i++ {
+			off := uint64(16 + i)
+			got, err := s.Read(off)
+			if i%2 == 1 {
+				require.Equal(t, ErrRecordDeleted, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+			require.Equal(t, fmt.Sprintf("record-%d", i), string(got.Value))
+		}
+	}
+	check(s)
+
+	// a rewrite that fails partway leaves the segment as it was and no defrag files behind
+	failed := errors.New("transform failed")
+	require.Equal(t, failed, s.rewrite(s.config, func(rel uint32, p []byte) ([]byte, error) {
+		if rel == 4 {
+			return nil, failed
+		}
+		return p, nil
+	}))
+	check(s)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	check(s)
+	off, err := s.Append(&api.Record{Value: []byte("record-10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(26), off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, "record-10", string(got.Value))
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentAppendUsing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-append-using-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Remove()
+
+	var buf []byte
+	for i := 0; i < 100; i++ {
+		var off uint64
+		// vary the size so the shared buffer is both grown and reused with leftovers
+		value := bytes.Repeat([]byte{byte(i)}, (i*37)%200+1)
+		off, buf, err = s.AppendUsing(&api.Record{Value: value}, buf)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	for i := 0; i < 100; i++ {
+		got, err := s.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), got.Offset)
+		require.Equal(t, bytes.Repeat([]byte{byte(i)}, (i*37)%200+1), got.Value)
+	}
+}
+
+func TestSegmentHeaders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-headers-test")
+	defer os.RemoveAll(dir)
+
+	headers := map[string][]byte{
+		"trace-id": []byte("4bf92f3577b34da6a3ce929d0e0e4736"),
+		"source":   []byte("ingest"),
+		"attempt":  {1},
+		"empty":    {},
+	}
+	plain := &api.Record{Value: []byte("hello world")}
+	// headers alone are enough to fill the store
+	c := Config{}
+	c.Segment.MaxStoreBytes = 2 * (lenWidth + uint64(proto.Size(plain)) + 1)
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	off, err := s.Append(&api.Record{Value: []byte("hello world"), Headers: headers})
+	require.NoError(t, err)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+	require.Equal(t, len(headers), len(got.Headers))
+	for k, v := range headers {
+		require.Equal(t, v, got.Headers[k], k)
+	}
+	require.Equal(t, lenWidth+uint64(proto.Size(got)), s.store.size)
+	require.True(t, s.IsMaxed())
+}
+
+func TestSegmentResetTo(t *testing.T) {
+	for name, every := range map[string]uint64{"dense": 1, "sparse": 3} {
+		t.Run(name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "segment-reset-to-test")
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = entWidth * 8
+			c.Segment.IndexEvery = every
+			s, err := newSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := 0; i < 6; i++ {
+				_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+				require.NoError(t, err)
+			}
+			if every == 1 {
+				// a deleted record right before the cut is dropped with it
+				require.NoError(t, s.Delete(19))
+			}
+			require.NoError(t, s.ResetTo(20))
+			require.NoError(t, s.CompactIndex())
+			require.NoError(t, s.Close())
+
+			s, err = newSegment(dir, 16, c)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, uint64(20), s.nextOffset)
+			_, err = s.Read(20)
+			require.Equal(t, io.EOF, err)
+			for off := uint64(20); !s.IsMaxed(); off++ {
+				got, err := s.Append(&api.Record{Value: []byte("after")})
+				require.NoError(t, err)
+				require.Equal(t, off, got)
+			}
+			require.Equal(t, 16+7*every+1, s.nextOffset)
+			for off := uint64(16); off < s.nextOffset; off++ {
+				got, err := s.Read(off)
+				if every == 1 && off == 19 {
+					require.Equal(t, ErrRecordDeleted, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, off, got.Offset)
+				want := "after"
+				if off < 20 {
+					want = fmt.Sprintf("record-%d", off-16)
+				}
+				require.Equal(t, want, string(got.Value))
+			}
+		})
+	}
+}
+
+func benchmarkSegment(b *testing.B) *segment {
+	b.Helper()
+	dir, _ := ioutil.TempDir("", "segment-bench")
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 30
+	c.Segment.MaxIndexBytes = entWidth * uint64(b.N+1)
+	s, err := newSegment(dir, 0, c)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Close() })
+	return s
+}
+
+func BenchmarkSegmentAppend(b *testing.B) {
+	s := benchmarkSegment(b)
+	record := &api.Record{Value: []byte("hello world")}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Append(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSegmentAppendUsing(b *testing.B) {
+	s := benchmarkSegment(b)
+	record := &api.Record{Value: []byte("hello world")}
+	var buf []byte
+	var err error
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, buf, err = s.AppendUsing(record, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOpenSegmentReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// copies named outside the log directory's convention
+	evidence, err := ioutil.TempDir("", "segment-read-only-evidence")
+	require.NoError(t, err)
+	defer os.RemoveAll(evidence)
+	storePath, indexPath := path.Join(evidence, "a"), path.Join(evidence, "b")
+	for from, to := range map[string]string{
+		path.Join(dir, "16.store"): storePath,
+		path.Join(dir, "16.index"): indexPath,
+	} {
+		b, err := ioutil.ReadFile(from)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(to, b, 0444))
+	}
+	indexBefore, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+
+	r, err := OpenSegmentReadOnly(storePath, indexPath, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), r.BaseOffset())
+	require.Equal(t, uint64(19), r.NextOffset())
+	for i := 0; i < 3; i++ {
+		record, err := r.Read(uint64(16 + i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+	s = r.(*segment)
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, s.Delete(16))
+	require.Equal(t, ErrReadOnly, s.Defragment())
+	require.NoError(t, r.Close())
+
+	indexAfter, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, indexBefore, indexAfter)
+	files, err := ioutil.ReadDir(evidence)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	_, err = OpenSegmentReadOnly(path.Join(evidence, "missing"), indexPath, 16, c)
+	require.True(t, os.IsNotExist(err))
+	_, err = OpenSegmentReadOnly(storePath, path.Join(evidence, "missing"), 16, c)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSegmentWriteOrder(t *testing.T) {
+	for _, order := range []WriteOrder{StoreFirst, IndexFirst} {
+		for _, every := range []uint64{1, 2} {
+			t.Run(fmt.Sprintf("order=%d/every=%d", order, every), func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "segment-write-order-test")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+
+				c := Config{}
+				c.WriteOrder = order
+				c.Segment.MaxStoreBytes = 1024
+				c.Segment.MaxIndexBytes = 1024
+				c.Segment.IndexEvery = every
+				s, err := newSegment(dir, 16, c)
+				require.NoError(t, err)
+				for i := 0; i < 2; i++ {
+					_, err = s.Append(&api.Record{Value: []byte("hello world")})
+					require.NoError(t, err)
+				}
+				size := s.store.size
+
+				// crash between the two halves of appending offset 18, the one store first writes in full
+				p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: 18})
+				require.NoError(t, err)
+				if order == IndexFirst {
+					require.NoError(t, s.index.Write(2, size))
+					_, _, err = s.store.Append(p)
+					require.NoError(t, err)
+					require.NoError(t, s.store.truncate(s.store.size-3))
+				} else {
+					_, _, err = s.store.Append(p)
+					require.NoError(t, err)
+				}
+				require.NoError(t, s.Close())
+
+				s, err = newSegment(dir, 16, c)
+				require.NoError(t, err)
+				defer s.Close()
+				if order == IndexFirst {
+					// the torn record is dropped with its entry
+					require.Equal(t, uint64(18), s.nextOffset)
+					require.Equal(t, size, s.store.size)
+				} else {
+					// the index doesn't know about the record until it's rebuilt
+					require.Equal(t, uint64(18), s.nextOffset)
+					_, err = s.rebuildIndex()
+					require.NoError(t, err)
+					require.Equal(t, uint64(19), s.nextOffset)
+				}
+				next := s.nextOffset
+				off, err := s.Append(&api.Record{Value: []byte("after")})
+				require.NoError(t, err)
+				require.Equal(t, next, off)
+				for o := uint64(16); o <= off; o++ {
+					record, err := s.Read(o)
+					require.NoError(t, err)
+					require.Equal(t, o, record.Offset)
+				}
+			})
+		}
+	}
+}
+
+func TestSegmentVerifyReadOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-verify-read-offset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.VerifyReadOffset = true
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for off := uint64(16); off < 19; off++ {
+		_, err = s.Read(off)
+		require.NoError(t, err)
+	}
+
+	// point the last entry at the first record
+	idx := s.index.(*index)
+	enc.PutUint64(idx.mmap[2*entWidth+offWidth:], 0)
+	_, err = s.Read(18)
+	require.True(t, errors.Is(err, ErrOffsetMismatch))
+
+	s.config.Segment.VerifyReadOffset = false
+	record, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), record.Offset)
+}
+
+func TestSegmentStrictOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-strict-offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// lenient segments overwrite whatever the offset was preset to
+	record := &api.Record{Value: []byte("hello world"), Offset: 42}
+	off, err := s.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), off)
+	require.Equal(t, uint64(16), record.Offset)
+
+	s.config.StrictOffsets = true
+	_, err = s.Append(&api.Record{Value: []byte("hello world"), Offset: 42})
+	require.True(t, errors.Is(err, ErrOffsetPreset))
+	require.Equal(t, uint64(17), s.nextOffset)
+	// the right offset and an unset one are fine
+	off, err = s.Append(&api.Record{Value: []byte("hello world"), Offset: 17})
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), off)
+	off, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), off)
+}
+
+func TestSegmentFirstLast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-first-last-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.First()
+	require.Equal(t, ErrSegmentEmpty, err)
+	_, err = s.Last()
+	require.Equal(t, ErrSegmentEmpty, err)
+
+	for i := 0; i < 4; i++ {
+		_, err = s.Append(&api.Record{Value: []byte{byte(i)}, Timestamp: int64(i)})
+		require.NoError(t, err)
+	}
+	first, err := s.First()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), first.Offset)
+	require.Equal(t, []byte{0}, first.Value)
+	last, err := s.Last()
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), last.Offset)
+	require.Equal(t, int64(3), last.Timestamp)
+
+	// deleted records are skipped over
+	require.NoError(t, s.Delete(16))
+	require.NoError(t, s.Delete(19))
+	first, err = s.First()
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), first.Offset)
+	last, err = s.Last()
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), last.Offset)
+}
@@ -0,0 +1,116 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+/*
+Split breaks the segment in two at the given offset: one with the records from its base offset up to at and one with
+the rest, starting at at. The store bytes of each half are copied as they are, so records keep their framing,
+encryption and compression, and the second half's index is rebuilt for its new base and positions; the first half's
+positions stay the same. The halves are written next to the segment's files and renamed over them once they're
+complete, the second half's first so a crash part way leaves records duplicated rather than lost. The segment is
+closed and shouldn't be used afterwards. Sparse indexes can't be split since their entries depend on the base offset.
+*/
+func (s *segment) Split(at uint64) (*segment, *segment, error) {
+	if s.readOnly {
+		return nil, nil, ErrReadOnly
+	}
+	if at <= s.baseOffset || at >= s.nextOffset {
+		return nil, nil, api.ErrOffsetOutOfRange{Offset: at}
+	}
+	if s.indexEvery() > 1 {
+		return nil, nil, ErrSparseIndex
+	}
+	entries, err := readAll(s.index)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the second half's records start with the first one at or after at that wasn't deleted
+	split := s.store.size
+	var first, second []IndexEntry
+	for _, e := range entries {
+		if s.baseOffset+uint64(e.Off) < at {
+			first = append(first, e)
+			continue
+		}
+		if e.Pos != tombstone && e.Pos < split {
+			split = e.Pos
+		}
+		second = append(second, e)
+	}
+	start := s.store.start()
+	for i, e := range second {
+		second[i].Off = uint32(s.baseOffset + uint64(e.Off) - at)
+		if e.Pos != tombstone {
+			second[i].Pos = e.Pos - split + start
+		}
+	}
+	dir := path.Dir(s.store.Name())
+	// the header comes along with both halves so they're in the same format
+	if err = s.writeHalf(dir, s.baseOffset, first, [2]uint64{0, split}); err != nil {
+		return nil, nil, err
+	}
+	if err = s.writeHalf(dir, at, second, [2]uint64{0, start}, [2]uint64{split, s.store.size}); err != nil {
+		return nil, nil, err
+	}
+	if err = s.Close(); err != nil {
+		return nil, nil, err
+	}
+	fs := s.config.fileSystem()
+	for _, base := range []uint64{at, s.baseOffset} {
+		for _, ext := range []string{".index", ".store"} {
+			name := path.Join(dir, fmt.Sprintf("%d%s", base, ext))
+			if err = fs.Rename(name+defragSuffix, name); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	before, err := newSegment(dir, s.baseOffset, s.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := newSegment(dir, at, s.config)
+	if err != nil {
+		before.Close()
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+/*
+writeHalf writes the files of one half of a split, named with defragSuffix: its index entries, and its store made of
+the store's bytes in the given [from, to) ranges in order.
+*/
+func (s *segment) writeHalf(dir string, base uint64, entries []IndexEntry, ranges ...[2]uint64) error {
+	fs := s.config.fileSystem()
+	name := path.Join(dir, fmt.Sprintf("%d", base))
+	storeFile, err := fs.OpenFile(name+".store"+defragSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	for _, rng := range ranges {
+		r := io.NewSectionReader(s.store, int64(rng[0]), int64(rng[1]-rng[0]))
+		if _, err = io.Copy(storeFile, r); err != nil {
+			return err
+		}
+	}
+	indexFile, err := fs.OpenFile(name+".index"+defragSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	if err = writeEntries(indexFile, entries); err != nil {
+		return err
+	}
+	if err = storeFile.Sync(); err != nil {
+		return err
+	}
+	return indexFile.Sync()
+}
@@ -0,0 +1,82 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentSplit(t *testing.T) {
+	for name, version := range map[string]uint8{"v1": FormatV1, "v2": FormatV2} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "segment-split-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Store.FormatVersion = version
+			s, err := newSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := 0; i < 6; i++ {
+				_, err = s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			// the record at the split is deleted, so the second half's bytes start with the next one
+			require.NoError(t, s.Delete(19))
+
+			_, _, err = s.Split(16)
+			require.Error(t, err)
+			_, _, err = s.Split(22)
+			require.Error(t, err)
+
+			before, after, err := s.Split(19)
+			require.NoError(t, err)
+			defer before.Close()
+			defer after.Close()
+			require.Equal(t, uint64(16), before.baseOffset)
+			require.Equal(t, uint64(19), before.nextOffset)
+			require.Equal(t, uint64(19), after.baseOffset)
+			require.Equal(t, uint64(22), after.nextOffset)
+			require.Equal(t, version, after.store.version)
+			for i := 0; i < 6; i++ {
+				off := uint64(16 + i)
+				half := before
+				if off >= 19 {
+					half = after
+				}
+				record, err := half.Read(off)
+				if off == 19 {
+					require.Equal(t, ErrRecordDeleted, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+				require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+			}
+
+			// the original's files are replaced by the halves', with nothing left over
+			files, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			var names []string
+			for _, file := range files {
+				names = append(names, file.Name())
+			}
+			require.Equal(t, []string{"16.index", "16.store", "19.index", "19.store"}, names)
+			fi, err := os.Stat(path.Join(dir, "16.store"))
+			require.NoError(t, err)
+			require.Equal(t, before.store.size, uint64(fi.Size()))
+
+			// the second half takes appends
+			off, err := after.Append(&api.Record{Value: []byte("appended")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(22), off)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+)
+
+/*
+Stats is a point-in-time summary of the log's size and activity. Appends and Reads count successful operations since
+the log was opened.
+*/
+type Stats struct {
+	Segments int
+	Bytes    uint64
+	Records  uint64
+	Appends  uint64
+	Reads    uint64
+	// WriteAmplification is the bytes written to store files per payload byte appended, see
+	// store.WriteAmplification
+	WriteAmplification float64
+}
+
+/*
+Stats returns the log's current Stats. Bytes counts both store and index bytes.
+*/
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.stats()
+}
+
+func (l *Log) stats() Stats {
+	stats := Stats{
+		Segments: len(l.segments),
+		Appends:  atomic.LoadUint64(&l.appends),
+		Reads:    atomic.LoadUint64(&l.reads),
+	}
+	var logical, physical uint64
+	for _, s := range l.segments {
+		stats.Bytes += s.store.size + s.index.Size()
+		stats.Records += s.nextOffset - s.baseOffset
+		s.store.mu.Lock()
+		logical += s.store.logicalWritten
+		physical += s.store.physicalWritten
+		s.store.mu.Unlock()
+	}
+	if logical > 0 {
+		stats.WriteAmplification = float64(physical) / float64(logical)
+	}
+	return stats
+}
+
+/*
+TotalPayloadBytes returns the bytes of record payloads across the log's segments, excluding framing overhead. This is
+what a metered deployment would bill for.
+*/
+func (l *Log) TotalPayloadBytes() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.PayloadBytes()
+	}
+	return total
+}
+
+/*
+TotalRecords returns the number of records across the log's segments like Stats.Records, counting from each segment's
+base offset to its next one so gaps left between segments don't count but deleted records do until they're truncated
+away. It's kept up to date as the log changes so it doesn't have to visit the segments.
+*/
+func (l *Log) TotalRecords() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.records
+}
+
+/*
+OpenFileCount returns how many OS files the log holds open: a store and an index for each segment and the lock on its
+directory. The manifest is only open while it's written. Closed and in-memory logs hold none.
+*/
+func (l *Log) OpenFileCount() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0
+	}
+	n := 0
+	if l.dirLock != nil {
+		n++
+	}
+	for _, s := range l.segments {
+		n += s.openFiles()
+	}
+	return n
+}
+
+/*
+openFiles returns how many OS files the segment holds open, which with Config.MaxOpenSegments can be none. Indexes
+from Config.Segment.NewIndex are given the index's *os.File, so they're counted as holding it.
+*/
+func (s *segment) openFiles() int {
+	if _, ok := s.store.File.(*memFile); ok {
+		return 0
+	}
+	n := 0
+	if isOpen(s.store.File) {
+		n++
+	}
+	if idx, ok := s.index.(*index); !ok || isOpen(idx.file) {
+		n++
+	}
+	return n
+}
+
+func isOpen(f file) bool {
+	switch f := f.(type) {
+	case *os.File:
+		return true
+	case *pooledFile:
+		return f.isOpen()
+	}
+	return false
+}
+
+/*
+recount adds up the records TotalRecords returns after the segments were replaced rather than appended to. Callers
+must hold the write lock.
+*/
+func (l *Log) recount() {
+	l.records = 0
+	for _, s := range l.segments {
+		l.records += s.nextOffset - s.baseOffset
+	}
+}
+
+/*
+Description is the document DescribeJSON emits: the log's Stats along with metadata for each segment.
+*/
+type Description struct {
+	Dir      string               `json:"dir"`
+	Segments []SegmentDescription `json:"segments"`
+	Bytes    uint64               `json:"bytes"`
+	Records  uint64               `json:"records"`
+	Appends  uint64               `json:"appends"`
+	Reads    uint64               `json:"reads"`
+}
+
+/*
+SegmentDescription describes a segment. NextOffset is the offset the segment's next record would get, and every
+segment but the active one is sealed.
+*/
+type SegmentDescription struct {
+	BaseOffset    uint64 `json:"base_offset"`
+	NextOffset    uint64 `json:"next_offset"`
+	StoreBytes    uint64 `json:"store_bytes"`
+	IndexBytes    uint64 `json:"index_bytes"`
+	DirtyBytes    uint64 `json:"dirty_bytes"`
+	FormatVersion uint8  `json:"format_version"`
+	Sealed        bool   `json:"sealed"`
+}
+
+/*
+DescribeJSON returns a JSON Description of the log for CLIs and dashboards.
+*/
+func (l *Log) DescribeJSON() ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := l.stats()
+	d := Description{
+		Dir:      l.Dir,
+		Segments: make([]SegmentDescription, 0, len(l.segments)),
+		Bytes:    stats.Bytes,
+		Records:  stats.Records,
+		Appends:  stats.Appends,
+		Reads:    stats.Reads,
+	}
+	for _, s := range l.segments {
+		d.Segments = append(d.Segments, SegmentDescription{
+			BaseOffset:    l.offset(s.baseOffset),
+			NextOffset:    l.offset(s.nextOffset),
+			StoreBytes:    s.store.size,
+			IndexBytes:    s.index.Size(),
+			DirtyBytes:    s.dirty,
+			FormatVersion: s.store.version,
+			Sealed:        s != l.activeSegment,
+		})
+	}
+	return json.Marshal(d)
+}
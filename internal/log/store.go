@@ -2,7 +2,15 @@ package log
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync"
 )
@@ -10,36 +18,344 @@ import (
 var (
 	// enc defines the encoding that we persist the record sizes and index entries in
 	enc = binary.BigEndian
+	// storeMagic starts the header of versioned store files. Unversioned files start with a record's big endian
+	// length prefix, whose high bytes are zero, so they never match.
+	storeMagic = []byte("PLOG")
+
+	ErrFormatVersion     = errors.New("log: store format version mismatch")
+	ErrChecksumMismatch  = errors.New("log: record checksum mismatch")
+	ErrStreamUnsupported = errors.New("log: streaming appends need an unencrypted v1 store")
+	ErrUntagged          = errors.New("log: transformer pipelines need a v2 store created with them")
+	ErrUnknownPipeline   = errors.New("log: record encoded by an unknown pipeline")
+	ErrNotFlushed        = errors.New("log: record not flushed to the store's file yet")
+	ErrTornRecord        = errors.New("log: record runs past the end of the store")
 )
 
 const (
 	// number of bytes used to store the records length
 	lenWidth = 8
+	// number of bytes used by the header of versioned store files: the magic, the version byte and padding
+	headerWidth = 8
+	// number of bytes used to store a record's checksum in v2 stores
+	crcWidth = 4
+)
+
+/*
+Store file format versions. FormatV1 is the original headerless layout of length-prefixed records. FormatV2 files
+start with a header and store a CRC-32 of each record between its length prefix and payload.
+*/
+const (
+	FormatV1 uint8 = iota + 1
+	FormatV2
+)
+
+/*
+Store header flags. flagTagged marks stores whose records are tagged with the pipeline that encoded them.
+*/
+const (
+	flagTagged uint8 = 1 << iota
+)
+
+/*
+Transformer is one stage of a pipeline that records' payloads are encoded with before they're stored, and decoded
+with in reverse order when they're read, say to compress, encrypt or frame payloads.
+*/
+type Transformer interface {
+	Encode(p []byte) ([]byte, error)
+	Decode(p []byte) ([]byte, error)
+}
+
+/*
+Codecs a store can compress its records with, recorded in the header of v2 stores. Only sealed segments are compressed,
+see Log.CompressSealed, so new writes never pay for it.
+*/
+const (
+	CodecNone uint8 = iota
+	CodecFlate
+	// CodecFlateSelective is CodecFlate for Config.CompressMinBytes: each record starts with a byte saying whether it
+	// was compressed, which only records over the threshold are.
+	CodecFlateSelective
+)
+
+/*
+SyncPolicy decides when segments are fsynced. SyncNone leaves it to the OS, SyncOnRoll syncs a segment when the log
+rolls past it, SyncInterval syncs the active segment periodically in the background and SyncAlways syncs after every
+append. The rolling policies also sync the sealed segment on roll since the ticker only syncs the active one.
+*/
+type SyncPolicy uint8
+
+/*
+StalePolicy decides whether store reads flush appends still in the buffer first. StaleNever always does, so reads see
+every record appended. StaleFlush only does for reads of bytes past what's been flushed, so reads of older records
+don't break up the buffer's batching, and StaleFail fails those with ErrNotFlushed instead, never flushing.
+*/
+type StalePolicy uint8
+
+const (
+	StaleNever StalePolicy = iota
+	StaleFlush
+	StaleFail
+)
+
+const (
+	SyncNone SyncPolicy = iota
+	SyncOnRoll
+	SyncInterval
+	SyncAlways
 )
 
 /*
 Simple wrapper around file with two APIs to append and read bytes to and from the file
 */
 type store struct {
-	*os.File
+	File file
 	mu sync.Mutex
-	buf *bufio.Writer
+	buf writeFlusher
 	size uint64
+	encrypter Encrypter
+	// version is the format of the file, configured is the format the config wants new records written in
+	version, configured uint8
+	// codec is what the records are compressed with, if anything, and compressMin the size records have to be over
+	// to be compressed with CodecFlateSelective
+	codec       uint8
+	compressMin uint64
+	// preallocated stores reserve their file up to the max store size and truncate it on close
+	preallocated bool
+	// tagged stores start every record's payload with the tag of the pipeline that encoded it
+	tagged      bool
+	pipelines   map[uint8][]Transformer
+	pipelineTag uint8
+	allowStale  StalePolicy
+	// payload counts the bytes of record payloads as given to Append, without any framing or encryption overhead
+	payload uint64
+	// logicalWritten and physicalWritten count the payload bytes appended since the store was opened and the bytes
+	// written to the file for them
+	logicalWritten  uint64
+	physicalWritten uint64
+	// lenBuf is where Append encodes length prefixes, a field since an array on the stack would escape through buf
+	lenBuf [lenWidth]byte
+	syncer func(f file) error
+}
+
+/*
+Encrypter encrypts record payloads at rest. The store generates a random nonce of NonceSize bytes for every record and
+persists it in front of the ciphertext. Key management is left to the implementation.
+*/
+type Encrypter interface {
+	NonceSize() int
+	Encrypt(nonce, plaintext []byte) ([]byte, error)
+	Decrypt(nonce, ciphertext []byte) ([]byte, error)
+}
+
+/*
+writeFlusher is what the store appends through: a bufio.Writer, or the file itself for unbuffered stores.
+*/
+type writeFlusher interface {
+	io.Writer
+	Flush() error
+	Buffered() int
+	Reset(w io.Writer)
+}
+
+/*
+fileWriter writes straight to the file, so there's never anything to flush.
+*/
+type fileWriter struct {
+	file
 }
 
-func newStore(f *os.File) (*store, error) {
+func (fileWriter) Flush() error {
+	return nil
+}
+
+func (fileWriter) Buffered() int {
+	return 0
+}
+
+func (fileWriter) Reset(io.Writer) {}
+
+func newStore(f file, c Config) (*store, error) {
+	return openStore(f, c, true)
+}
+
+/*
+openStore opens a store like newStore, only counting its payload bytes if count is set. Otherwise the caller knows
+them already and sets them.
+*/
+func openStore(f file, c Config, count bool) (*store, error) {
 	// Get file info especially size
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	// Get file size in uint64
 	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
 		size: size,
 		buf: bufio.NewWriter(f),
-	}, nil
+		encrypter: c.Store.Encrypter,
+		allowStale: c.Store.AllowStale,
+		configured: c.Store.FormatVersion,
+		pipelines: c.Store.Pipelines,
+		pipelineTag: c.Store.PipelineTag,
+		compressMin: c.CompressMinBytes,
+	}
+	if c.Store.Unbuffered {
+		s.buf = fileWriter{f}
+	}
+	s.syncer = file.Sync
+	if _, ok := f.(*memFile); !ok && c.Store.Syncer != nil {
+		s.syncer = func(f file) error {
+			if ok, err := withOSFile(f, c.Store.Syncer); ok {
+				return err
+			}
+			return f.Sync()
+		}
+	}
+	if s.configured == 0 {
+		s.configured = FormatV1
+	}
+	if err = s.readHeader(c); err != nil {
+		return nil, err
+	}
+	if c.Store.Preallocate {
+		if err = s.preallocate(c.Segment.MaxStoreBytes); err != nil {
+			return nil, err
+		}
+	}
+	if !count {
+		return s, nil
+	}
+	if s.payload, err = s.countPayload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+preallocate works out where the records end in a file that was preallocated before and maybe not truncated by a
+clean close, then reserves the file up to max so appends overwrite the reserved space rather than growing the file.
+The records end at the first zero length prefix, which a record can only have if its payload is empty, something
+segments never append. The file mustn't be opened with O_APPEND since appends are written at the store's size.
+*/
+func (s *store) preallocate(max uint64) error {
+	s.preallocated = true
+	pos := s.start()
+	for pos+lenWidth <= s.size {
+		n, err := s.ReadLen(pos)
+		if err != nil {
+			return err
+		}
+		next := pos + s.width(n)
+		if n == 0 || next > s.size || next < pos {
+			break
+		}
+		pos = next
+	}
+	s.size = pos
+	if max > s.size {
+		if _, err := withOSFile(s.File, func(f *os.File) error {
+			return fallocate(f, int64(max))
+		}); err != nil {
+			return err
+		}
+	}
+	_, err := s.File.Seek(int64(s.size), io.SeekStart)
+	return err
+}
+
+/*
+countPayload adds up the payload bytes of the records in the store. Encrypters that report their Overhead, like
+cipher.AEAD, let us work it out from the length prefixes alone; otherwise we decrypt each record. We stop at a torn
+record at the end of the file, or one that doesn't decrypt or decompress, rather than failing so a damaged store can
+still be opened and repaired.
+*/
+func (s *store) countPayload() (uint64, error) {
+	var total uint64
+	overhead, knowsOverhead := s.encrypter.(interface{ Overhead() int })
+scan:
+	for pos := s.start(); pos+lenWidth <= s.size; {
+		n, err := s.ReadLen(pos)
+		if err != nil {
+			return 0, err
+		}
+		next := pos + s.width(n)
+		if next > s.size || next < pos {
+			break
+		}
+		switch {
+		case s.codec != CodecNone || s.tagged:
+			// only the encoded size is in the length prefix
+			p, err := s.Read(pos)
+			if err != nil {
+				break scan
+			}
+			total += uint64(len(p))
+		case s.encrypter == nil:
+			total += n
+		case knowsOverhead:
+			total += n - uint64(overhead.Overhead())
+		default:
+			p, err := s.Read(pos)
+			if err != nil {
+				break scan
+			}
+			total += uint64(len(p))
+		}
+		pos = next
+	}
+	return total, nil
+}
+
+/*
+readHeader detects the format, codec and flags of the store file from its header. New files take the configured
+version, the given codec and flags for the config and get their header written straight away.
+*/
+func (s *store) readHeader(c Config) error {
+	if s.size == 0 {
+		s.version = s.configured
+		if s.configured == FormatV1 {
+			return nil
+		}
+		s.codec, s.tagged = c.Store.codec, c.Store.Pipelines != nil
+		if _, err := s.File.Write(storeHeader(s.configured, s.codec, c.storeFlags())); err != nil {
+			return err
+		}
+		s.size = headerWidth
+		return nil
+	}
+	s.version = FormatV1
+	if s.size < headerWidth {
+		return nil
+	}
+	header := make([]byte, headerWidth)
+	if _, err := s.File.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(storeMagic)], storeMagic) {
+		return nil
+	}
+	if s.version = header[len(storeMagic)]; s.version != FormatV2 {
+		return fmt.Errorf("log: unsupported store format version %d in %s", s.version, s.Name())
+	}
+	if s.codec = header[len(storeMagic)+1]; s.codec > CodecFlateSelective {
+		return fmt.Errorf("log: unsupported store codec %d in %s", s.codec, s.Name())
+	}
+	s.tagged = header[len(storeMagic)+2]&flagTagged != 0
+	return nil
+}
+
+/*
+storeHeader returns the header of a versioned store: the magic, the version, the codec and the flags.
+*/
+func storeHeader(version, codec, flags uint8) []byte {
+	header := make([]byte, headerWidth)
+	copy(header, storeMagic)
+	header[len(storeMagic)] = version
+	header[len(storeMagic)+1] = codec
+	header[len(storeMagic)+2] = flags
+	return header
 }
 
 /*
@@ -48,8 +364,135 @@ Append adds
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err = s.writable(); err != nil {
+		return 0, 0, err
+	}
+	return s.append(p)
+}
+
+/*
+AppendMany appends every record in ps under one acquisition of the lock and flushes once at the end, returning each
+record's position and the bytes written in all. It's all or nothing: if any record fails the store is cut back to
+where the batch began. Anything buffered from earlier appends is flushed first so the rollback can't lose it.
+*/
+func (s *store) AppendMany(ps [][]byte) ([]uint64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writable(); err != nil {
+		return nil, 0, err
+	}
+	if err := s.flushPending(); err != nil {
+		return nil, 0, err
+	}
+	start, payload := s.size, s.payload
+	logical, physical := s.logicalWritten, s.physicalWritten
+	positions := make([]uint64, 0, len(ps))
+	for _, p := range ps {
+		_, pos, err := s.append(p)
+		if err == nil {
+			positions = append(positions, pos)
+			continue
+		}
+		if err := s.rollback(start); err != nil {
+			return nil, 0, err
+		}
+		s.payload = payload
+		s.logicalWritten, s.physicalWritten = logical, physical
+		return nil, 0, err
+	}
+	if err := s.buf.Flush(); err != nil {
+		if err := s.rollback(start); err != nil {
+			return nil, 0, err
+		}
+		s.payload = payload
+		s.logicalWritten, s.physicalWritten = logical, physical
+		return nil, 0, err
+	}
+	return positions, s.size - start, nil
+}
+
+/*
+rollback throws away whatever's buffered and truncates the file back to size.
+*/
+func (s *store) rollback(size uint64) error {
+	s.buf.Reset(s.File)
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	// files not opened with O_APPEND would carry on writing past the end
+	if _, err := s.File.Seek(int64(size), io.SeekStart); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+/*
+writable checks that the store's format is the one the config writes, and that it tags records if the config has
+pipelines to encode them with.
+*/
+func (s *store) writable() error {
+	if s.version != s.configured {
+		return fmt.Errorf(
+			"%w: %s is v%d, config writes v%d", ErrFormatVersion, s.Name(), s.version, s.configured,
+		)
+	}
+	if s.pipelines != nil && !s.tagged {
+		return fmt.Errorf("%w: %s", ErrUntagged, s.Name())
+	}
+	return nil
+}
+
+/*
+append writes a record to the buffer. The caller holds the lock.
+*/
+func (s *store) append(p []byte) (n uint64, pos uint64, err error) {
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	payload := uint64(len(p))
+	switch s.codec {
+	case CodecFlate:
+		if p, err = compress(p); err != nil {
+			return 0, 0, err
+		}
+	case CodecFlateSelective:
+		if uint64(len(p)) <= s.compressMin {
+			p = append([]byte{0}, p...)
+		} else if p, err = compress(p); err != nil {
+			return 0, 0, err
+		} else {
+			p = append([]byte{1}, p...)
+		}
+	}
+	if s.tagged {
+		if p, err = s.encode(p); err != nil {
+			return 0, 0, err
+		}
+	}
+	var nonce []byte
+	if s.encrypter != nil {
+		// encryption is the last transform applied so the nonce and ciphertext are what land on disk
+		nonce = make([]byte, s.encrypter.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return 0, 0, err
+		}
+		if p, err = s.encrypter.Encrypt(nonce, p); err != nil {
+			return 0, 0, err
+		}
+	}
+	// binary.Write would allocate for the length on every append
+	enc.PutUint64(s.lenBuf[:], uint64(len(p)))
+	if _, err := s.buf.Write(s.lenBuf[:]); err != nil {
+		return 0, 0, err
+	}
+	var crc []byte
+	if s.version == FormatV2 {
+		crc = make([]byte, crcWidth)
+		enc.PutUint32(crc, crc32.Update(crc32.ChecksumIEEE(nonce), crc32.IEEETable, p))
+		if _, err := s.buf.Write(crc); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := s.buf.Write(nonce); err != nil {
 		return 0, 0, err
 	}
 	// Write to buffered writer instead of file directly to reduce the number of system calls and improve performance
@@ -57,33 +500,330 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += lenWidth + len(crc) + len(nonce)
 	s.size += uint64(w)
+	s.payload += payload
+	s.logicalWritten += payload
+	s.physicalWritten += uint64(w)
 	return uint64(w), pos, nil
 }
 
+/*
+AppendReader appends a record of exactly size bytes streamed from r, so large payloads don't have to be held in memory.
+Checksums and encryption need the whole payload before the record is written, so it only works on unencrypted v1
+stores. If r comes up short the store is truncated back to where the record began.
+*/
+func (s *store) AppendReader(r io.Reader, size uint64) (n uint64, pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.writable(); err != nil {
+		return 0, 0, err
+	}
+	if s.version != FormatV1 || s.encrypter != nil {
+		return 0, 0, ErrStreamUnsupported
+	}
+	pos = s.size
+	enc.PutUint64(s.lenBuf[:], size)
+	if _, err = s.buf.Write(s.lenBuf[:]); err != nil {
+		return 0, 0, err
+	}
+	if _, err = io.CopyN(s.buf, r, int64(size)); err != nil {
+		if err := s.buf.Flush(); err != nil {
+			return 0, 0, err
+		}
+		if err := s.rollback(pos); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, err
+	}
+	n = lenWidth + size
+	s.size += n
+	s.payload += size
+	s.logicalWritten += size
+	s.physicalWritten += n
+	return n, pos, nil
+}
+
+/*
+AppendVectored appends one record whose payload is the chunks in order, writing them one after another behind a single
+length prefix rather than concatenating them first, and returns its position. Stores that compress, encode or encrypt
+records need the whole payload to do so and concatenate the chunks anyway.
+*/
+func (s *store) AppendVectored(chunks [][]byte) (pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.writable(); err != nil {
+		return 0, err
+	}
+	if s.codec != CodecNone || s.tagged || s.encrypter != nil {
+		_, pos, err = s.append(bytes.Join(chunks, nil))
+		return pos, err
+	}
+	pos = s.size
+	var size uint64
+	var crc uint32
+	for _, c := range chunks {
+		size += uint64(len(c))
+		crc = crc32.Update(crc, crc32.IEEETable, c)
+	}
+	enc.PutUint64(s.lenBuf[:], size)
+	if _, err = s.buf.Write(s.lenBuf[:]); err != nil {
+		return 0, err
+	}
+	n := lenWidth + size
+	if s.version == FormatV2 {
+		b := make([]byte, crcWidth)
+		enc.PutUint32(b, crc)
+		if _, err = s.buf.Write(b); err != nil {
+			return 0, err
+		}
+		n += crcWidth
+	}
+	for _, c := range chunks {
+		if _, err = s.buf.Write(c); err != nil {
+			return 0, err
+		}
+	}
+	s.size += n
+	s.payload += size
+	s.logicalWritten += size
+	s.physicalWritten += n
+	return pos, nil
+}
+
 /*
 Read returns the record stored at the given position
 */
 func (s *store) Read(pos uint64) ([]byte, error) {
+	b, err := s.ReadRaw(pos)
+	if err != nil {
+		return nil, err
+	}
+	return uncompress(s.codec, b)
+}
+
+/*
+ReadRaw returns the record stored at the given position like Read but still compressed with the store's codec.
+*/
+func (s *store) ReadRaw(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// First flush write buffer, in case we're about to try to read a record
 	// that the buffer hasn't flushed to disk yet.
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flushFor(pos + lenWidth); err != nil {
 		return nil, err
 	}
 	size := make([]byte, lenWidth)
 	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
+	// a corrupt length prefix mustn't have us allocate more than the store holds
+	n := enc.Uint64(size)
+	if end := pos + s.width(n); n > s.size || end > s.size || end < pos {
+		return nil, fmt.Errorf("%w: record at %d", ErrTornRecord, pos)
+	}
+	b := make([]byte, s.overhead()+n)
+	if err := s.flushFor(pos + lenWidth + uint64(len(b))); err != nil {
+		return nil, err
+	}
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
+	switch s.version {
+	case FormatV2:
+		if enc.Uint32(b[:crcWidth]) != crc32.ChecksumIEEE(b[crcWidth:]) {
+			return nil, ErrChecksumMismatch
+		}
+		b = b[crcWidth:]
+	}
+	if s.encrypter != nil {
+		nonce := b[:s.encrypter.NonceSize()]
+		var err error
+		if b, err = s.encrypter.Decrypt(nonce, b[len(nonce):]); err != nil {
+			return nil, err
+		}
+	}
+	if s.tagged {
+		var err error
+		if b, err = s.decode(b); err != nil {
+			return nil, err
+		}
+	}
 	return b, nil
 }
 
+/*
+encode runs p through the configured pipeline and prefixes it with the pipeline's tag. Tag zero is reserved for
+records stored as they are.
+*/
+func (s *store) encode(p []byte) ([]byte, error) {
+	var err error
+	for _, t := range s.pipelines[s.pipelineTag] {
+		if p, err = t.Encode(p); err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte{s.pipelineTag}, p...), nil
+}
+
+/*
+decode undoes encode with the pipeline named by p's tag, which needn't be the one new records are encoded with.
+*/
+func (s *store) decode(p []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, ErrUnknownPipeline
+	}
+	tag, p := p[0], p[1:]
+	pipeline, ok := s.pipelines[tag]
+	if !ok && tag != 0 {
+		return nil, fmt.Errorf("%w: tag %d", ErrUnknownPipeline, tag)
+	}
+	var err error
+	for i := len(pipeline) - 1; i >= 0; i-- {
+		if p, err = pipeline[i].Decode(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func compress(p []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(p); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+/*
+uncompress undoes the codec's compression of a record.
+*/
+func uncompress(codec uint8, p []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return p, nil
+	case CodecFlate:
+		return decompress(p)
+	case CodecFlateSelective:
+		if len(p) == 0 {
+			return nil, ErrBadRecord
+		}
+		if p[0] == 0 {
+			return p[1:], nil
+		}
+		return decompress(p[1:])
+	}
+	return nil, fmt.Errorf("log: unsupported codec %d", codec)
+}
+
+func decompress(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+/*
+flushPending flushes the buffer only if it holds appends, so reads of segments that aren't being appended to skip the
+flush. Callers must hold the lock.
+*/
+func (s *store) flushPending() error {
+	if s.buf.Buffered() == 0 {
+		return nil
+	}
+	return s.buf.Flush()
+}
+
+/*
+flushFor makes sure the bytes before end are in the file so they can be read, flushing as Config.Store.AllowStale
+says. Callers must hold the lock.
+*/
+func (s *store) flushFor(end uint64) error {
+	if s.allowStale == StaleNever || end > s.flushedSize() {
+		if s.allowStale == StaleFail {
+			return ErrNotFlushed
+		}
+		return s.flushPending()
+	}
+	return nil
+}
+
+/*
+flushedSize is how much of the store is in its file, the rest still being in the buffer. Callers must hold the lock.
+*/
+func (s *store) flushedSize() uint64 {
+	return s.size - uint64(s.buf.Buffered())
+}
+
+/*
+ReadLen returns the length of the record stored at the given position by reading only its length prefix, so callers
+can size buffers or skip large records without reading the payload. For encrypted stores this is the ciphertext length.
+*/
+func (s *store) ReadLen(pos uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushFor(pos + lenWidth); err != nil {
+		return 0, err
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+		return 0, err
+	}
+	return enc.Uint64(size), nil
+}
+
+/*
+PayloadBytes returns the bytes of record payloads in the store, excluding length prefixes, checksums and encryption
+overhead.
+*/
+func (s *store) PayloadBytes() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.payload
+}
+
+/*
+WriteAmplification returns the bytes written to the store's file for every payload byte appended since it was opened,
+showing how much the length prefixes, checksums, encryption and compression add for the workload. It's zero until
+something's been appended.
+*/
+func (s *store) WriteAmplification() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logicalWritten == 0 {
+		return 0
+	}
+	return float64(s.physicalWritten) / float64(s.logicalWritten)
+}
+
+/*
+width returns the number of bytes a record with the given length prefix takes up in the store, so callers can step
+from one record to the next.
+*/
+func (s *store) width(n uint64) uint64 {
+	return lenWidth + s.overhead() + n
+}
+
+/*
+overhead returns the number of bytes stored between the length prefix and the payload.
+*/
+func (s *store) overhead() uint64 {
+	var n uint64
+	if s.version == FormatV2 {
+		n += crcWidth
+	}
+	if s.encrypter != nil {
+		n += uint64(s.encrypter.NonceSize())
+	}
+	return n
+}
+
 /*
 ReadAt reads len(p) bytes into p beginning at the off offset in the store's file.
 */
@@ -91,12 +831,84 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	// defer causes mu.Unlock() to be executed when the current scope is executed ( e.g. a function that returns )
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flushFor(uint64(off) + uint64(len(p))); err != nil {
 		return 0, err
 	}
 	return s.File.ReadAt(p, off)
 }
 
+/*
+Reader flushes the buffer and returns a reader over the whole store from position 0 up to its size at the time of the
+call, so records appended while it's being read aren't seen half written.
+*/
+func (s *store) Reader() (io.Reader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(s.File, 0, int64(s.size)), nil
+}
+
+/*
+copyTo writes the store's contents up to its current size to w.
+*/
+func (s *store) copyTo(w io.Writer) error {
+	r, err := s.Reader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+/*
+Flush writes the buffered appends to the file without syncing it, so other readers of the file see them. They survive
+the process crashing but not the machine, see sync.
+*/
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushPending()
+}
+
+/*
+sync flushes the buffer and commits the file's contents to stable storage. The lock is only held for the flush so reads
+don't wait for the fsync.
+*/
+func (s *store) sync() error {
+	s.mu.Lock()
+	err := s.buf.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.syncer(s.File)
+}
+
+/*
+trim flushes the store and truncates its file to the logical size if it's any bigger.
+*/
+func (s *store) trim() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	fi, err := s.File.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(fi.Size()) <= s.size {
+		return nil
+	}
+	return s.File.Truncate(int64(s.size))
+}
+
+func (s *store) Name() string {
+	return s.File.Name()
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -104,6 +916,11 @@ func (s *store) Close() error {
 	if err != nil {
 		return err
 	}
+	if s.preallocated {
+		if err = s.File.Truncate(int64(s.size)); err != nil {
+			return err
+		}
+	}
 	return s.File.Close()
 }
 
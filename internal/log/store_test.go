@@ -1,9 +1,16 @@
 package log
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"testing"
 )
 
@@ -17,14 +24,14 @@ func TestStoreAppendRead(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
 
-	s, err = newStore(f)
+	s, err = newStore(f, Config{})
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -68,11 +75,194 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreReadLen(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_len_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+
+	records := [][]byte{write, []byte("a"), make([]byte, 512)}
+	var positions []uint64
+	for _, p := range records {
+		_, pos, err := s.Append(p)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	for i, pos := range positions {
+		n, err := s.ReadLen(pos)
+		require.NoError(t, err)
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(records[i])), n)
+		require.Equal(t, uint64(len(read)), n)
+	}
+}
+
+type aesGCM struct {
+	cipher.AEAD
+}
+
+func (a aesGCM) Encrypt(nonce, plaintext []byte) ([]byte, error) {
+	return a.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func (a aesGCM) Decrypt(nonce, ciphertext []byte) ([]byte, error) {
+	return a.Open(nil, nonce, ciphertext, nil)
+}
+
+func newAESGCM(t *testing.T) aesGCM {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	return aesGCM{aead}
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_encrypted_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.Encrypter = newAESGCM(t)
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(t, s.Close())
+
+	raw, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, write))
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+}
+
+func TestStoreAppendVectored(t *testing.T) {
+	chunks := [][]byte{[]byte("hello"), nil, []byte(" "), []byte("world")}
+	for name, configure := range map[string]func(c *Config){
+		"v1":        func(c *Config) {},
+		"v2":        func(c *Config) { c.Store.FormatVersion = FormatV2 },
+		"encrypted": func(c *Config) { c.Store.Encrypter = newAESGCM(t) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "store_append_vectored_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			configure(&c)
+			s, err := newStore(f, c)
+			require.NoError(t, err)
+			defer s.Close()
+			pos, err := s.AppendVectored(chunks)
+			require.NoError(t, err)
+			// the record is the same as appending the chunks concatenated
+			n, next, err := s.Append(bytes.Join(chunks, nil))
+			require.NoError(t, err)
+			require.Equal(t, pos+n, next)
+			require.Equal(t, next+n, s.size)
+			require.Equal(t, 2*uint64(len(write)), s.payload)
+
+			for _, pos := range []uint64{pos, next} {
+				read, err := s.Read(pos)
+				require.NoError(t, err)
+				require.Equal(t, write, read)
+			}
+			if c.Store.Encrypter == nil {
+				first, second := make([]byte, n), make([]byte, n)
+				_, err = s.ReadAt(first, int64(pos))
+				require.NoError(t, err)
+				_, err = s.ReadAt(second, int64(next))
+				require.NoError(t, err)
+				require.Equal(t, second, first)
+			}
+		})
+	}
+}
+
+func TestStoreFormatVersion(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_format_version_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	v2 := Config{}
+	v2.Store.FormatVersion = FormatV2
+	s, err := newStore(f, v2)
+	require.NoError(t, err)
+	require.Equal(t, FormatV2, s.version)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(headerWidth), pos)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NoError(t, s.Close())
+
+	// the version is detected from the header, and appends in another version are refused
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, Config{})
+	require.NoError(t, err)
+	require.Equal(t, FormatV2, s.version)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, _, err = s.Append(write)
+	require.True(t, errors.Is(err, ErrFormatVersion))
+
+	// v2 records are checksummed
+	corrupt, err := os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = corrupt.WriteAt([]byte("J"), int64(pos+lenWidth+crcWidth))
+	require.NoError(t, err)
+	require.NoError(t, corrupt.Close())
+	_, err = s.Read(pos)
+	require.Equal(t, ErrChecksumMismatch, err)
+	require.NoError(t, s.Close())
+
+	f, err = ioutil.TempFile("", "store_format_version_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err = newStore(f, Config{})
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, v2)
+	require.NoError(t, err)
+	require.Equal(t, FormatV1, s.version)
+	read, err = s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, _, err = s.Append(write)
+	require.True(t, errors.Is(err, ErrFormatVersion))
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 	_, _, err = s.Append(write)
 	require.NoError(t, err)
@@ -104,3 +294,546 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	return f, fi.Size(), nil
 
 }
+
+func TestStorePayloadBytes(t *testing.T) {
+	records := [][]byte{write, []byte("a"), make([]byte, 300)}
+	var want uint64
+	for _, p := range records {
+		want += uint64(len(p))
+	}
+
+	encrypted := Config{}
+	encrypted.Store.Encrypter = newAESGCM(t)
+	encrypted.Store.FormatVersion = FormatV2
+	for name, c := range map[string]Config{"plain": {}, "encrypted": encrypted} {
+		t.Run(name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "store_payload_bytes_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			s, err := newStore(f, c)
+			require.NoError(t, err)
+			for _, p := range records {
+				_, _, err := s.Append(p)
+				require.NoError(t, err)
+			}
+			require.Equal(t, want, s.PayloadBytes())
+			require.True(t, s.size > want)
+			require.NoError(t, s.Close())
+
+			// recomputed from the file on open
+			f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+			require.NoError(t, err)
+			s, err = newStore(f, c)
+			require.NoError(t, err)
+			require.Equal(t, want, s.PayloadBytes())
+			require.NoError(t, s.Close())
+		})
+	}
+}
+
+func TestStoreReader(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_reader_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+
+	r, err := s.Reader()
+	require.NoError(t, err)
+	// appended after the reader was created so it shouldn't be seen
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	want, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int(width*3), len(got))
+	require.Equal(t, want[:width*3], got)
+}
+
+func TestStoreUnbuffered(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_unbuffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.Unbuffered = true
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	// the bytes are in the file without anything flushing them
+	b := make([]byte, width)
+	_, err = f.ReadAt(b, int64(pos))
+	require.NoError(t, err)
+	require.Equal(t, write, b[lenWidth:])
+
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.Equal(t, width, s.size)
+}
+
+func TestStoreAllowStale(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_allow_stale_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.AllowStale = StaleFlush
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, flushed, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+	_, buffered, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width, s.flushedSize())
+
+	// reads below what's been flushed leave the buffer alone
+	read, err := s.Read(flushed)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	n, err := s.ReadLen(flushed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(write)), n)
+	require.Equal(t, int(width), s.buf.Buffered())
+
+	s.allowStale = StaleFail
+	_, err = s.Read(buffered)
+	require.Equal(t, ErrNotFlushed, err)
+	_, err = s.ReadAt(make([]byte, width), int64(buffered))
+	require.Equal(t, ErrNotFlushed, err)
+	require.Equal(t, int(width), s.buf.Buffered())
+
+	s.allowStale = StaleFlush
+	read, err = s.Read(buffered)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.Equal(t, 0, s.buf.Buffered())
+	require.Equal(t, 2*width, s.flushedSize())
+}
+
+func TestStoreAppendBytes(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_append_bytes_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	records := [][]byte{write, {}, make([]byte, 300)}
+	var want bytes.Buffer
+	for _, p := range records {
+		_, _, err := s.Append(p)
+		require.NoError(t, err)
+		// what binary.Write produced for the length prefix before
+		require.NoError(t, binary.Write(&want, enc, uint64(len(p))))
+		want.Write(p)
+	}
+	require.NoError(t, s.Close())
+
+	got, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), got)
+}
+
+func BenchmarkStoreAppend(b *testing.B) {
+	f, err := ioutil.TempFile("", "store_append_benchmark")
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(b, err)
+	defer s.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.Append(write); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStoreReadAtBuffered(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_at_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, int(width), s.buf.Buffered())
+
+	// reading a buffered record flushes it first
+	b := make([]byte, len(write))
+	_, err = s.ReadAt(b, int64(pos+lenWidth))
+	require.NoError(t, err)
+	require.Equal(t, write, b)
+	require.Equal(t, 0, s.buf.Buffered())
+
+	// and with nothing buffered the read goes straight to the file
+	_, err = s.ReadAt(b, int64(pos+lenWidth))
+	require.NoError(t, err)
+	require.Equal(t, write, b)
+}
+
+func BenchmarkStoreReadAt(b *testing.B) {
+	f, err := ioutil.TempFile("", "store_read_at_benchmark")
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(b, err)
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		_, _, err := s.Append(write)
+		require.NoError(b, err)
+	}
+	require.NoError(b, s.buf.Flush())
+	p := make([]byte, len(write))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ReadAt(p, int64(uint64(i%100)*width+lenWidth)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStoreAppendReader(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_append_reader_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	size := uint64(10 << 20)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), int(size/16))
+	n, pos, err := s.AppendReader(bytes.NewReader(payload), size)
+	require.NoError(t, err)
+	require.Equal(t, width, pos)
+	require.Equal(t, lenWidth+size, n)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(payload, read))
+
+	// a short reader leaves the store as it was
+	_, _, err = s.AppendReader(bytes.NewReader(write), uint64(len(write))+1)
+	require.Error(t, err)
+	require.Equal(t, pos+n, s.size)
+	_, pos, err = s.Append(write)
+	require.NoError(t, err)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	c := Config{}
+	c.Store.FormatVersion = FormatV2
+	g, err := ioutil.TempFile("", "store_append_reader_test")
+	require.NoError(t, err)
+	defer os.Remove(g.Name())
+	v2, err := newStore(g, c)
+	require.NoError(t, err)
+	defer v2.Close()
+	_, _, err = v2.AppendReader(bytes.NewReader(write), uint64(len(write)))
+	require.Equal(t, ErrStreamUnsupported, err)
+}
+
+/*
+failingWriter lets left bytes through to the file and fails every write after that.
+*/
+type failingWriter struct {
+	fileWriter
+	left int
+}
+
+var errInjected = errors.New("injected write failure")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		return 0, errInjected
+	}
+	w.left -= len(p)
+	return w.fileWriter.Write(p)
+}
+
+func TestStoreAppendMany(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_append_many_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	positions, n, err := s.AppendMany([][]byte{write, write, write})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{width, 2 * width, 3 * width}, positions)
+	require.Equal(t, 3*width, n)
+	require.Equal(t, 0, s.buf.Buffered())
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+
+	// fail part way through the second record, after the first has reached the file
+	size, payload := s.size, s.payload
+	logical, physical := s.logicalWritten, s.physicalWritten
+	buf := s.buf
+	s.buf = &failingWriter{fileWriter: fileWriter{f}, left: int(width) + lenWidth}
+	_, _, err = s.AppendMany([][]byte{write, write, write})
+	require.Equal(t, errInjected, err)
+	require.Equal(t, size, s.size)
+	require.Equal(t, payload, s.payload)
+	require.Equal(t, logical, s.logicalWritten)
+	require.Equal(t, physical, s.physicalWritten)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+
+	s.buf = buf
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, size, pos)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func BenchmarkStoreAppendMany(b *testing.B) {
+	f, err := ioutil.TempFile("", "store_append_many_benchmark")
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(b, err)
+	defer s.Close()
+	batch := make([][]byte, 100)
+	for i := range batch {
+		batch[i] = write
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(batch) {
+		if _, _, err := s.AppendMany(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type flateTransformer struct{}
+
+func (flateTransformer) Encode(p []byte) ([]byte, error) {
+	return compress(p)
+}
+
+func (flateTransformer) Decode(p []byte) ([]byte, error) {
+	return decompress(p)
+}
+
+/*
+sealTransformer encrypts with a random nonce it keeps in front of the ciphertext.
+*/
+type sealTransformer struct {
+	aesGCM
+}
+
+func (s sealTransformer) Encode(p []byte) ([]byte, error) {
+	nonce := make([]byte, s.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.Seal(nonce, nonce, p, nil), nil
+}
+
+func (s sealTransformer) Decode(p []byte) ([]byte, error) {
+	if len(p) < s.NonceSize() {
+		return nil, errors.New("short ciphertext")
+	}
+	return s.Open(nil, p[:s.NonceSize()], p[s.NonceSize():], nil)
+}
+
+func TestStorePipelines(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_pipelines_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.FormatVersion = FormatV2
+	c.Store.Pipelines = map[uint8][]Transformer{
+		1: {flateTransformer{}, sealTransformer{newAESGCM(t)}},
+		2: {flateTransformer{}},
+	}
+	c.Store.PipelineTag = 1
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	payload := bytes.Repeat(write, 100)
+	_, compressedAndSealed, err := s.Append(payload)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	raw, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, write))
+	require.Less(t, len(raw), len(payload))
+	require.Equal(t, uint8(1), raw[compressedAndSealed+lenWidth+crcWidth])
+
+	// new records take the new tag, and the old ones still decode with theirs
+	c.Store.PipelineTag = 2
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	_, compressed, err := s.Append(payload)
+	require.NoError(t, err)
+	s.pipelineTag = 0
+	_, plain, err := s.Append(write)
+	require.NoError(t, err)
+	for pos, want := range map[uint64][]byte{compressedAndSealed: payload, compressed: payload, plain: write} {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, want, read)
+	}
+	require.Equal(t, uint64(len(payload)*2+len(write)), s.payload)
+
+	// dropping a pipeline leaves its records unreadable, the store shares the config's map
+	delete(c.Store.Pipelines, 1)
+	_, err = s.Read(compressedAndSealed)
+	require.True(t, errors.Is(err, ErrUnknownPipeline))
+	require.NoError(t, s.Close())
+
+	// stores that weren't created with pipelines don't take appends through them
+	g, err := ioutil.TempFile("", "store_pipelines_test")
+	require.NoError(t, err)
+	defer os.Remove(g.Name())
+	s, err = newStore(g, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	s.pipelines = c.Store.Pipelines
+	_, _, err = s.Append(write)
+	require.True(t, errors.Is(err, ErrUntagged))
+}
+
+func TestStorePreallocate(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_preallocate_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Store.Preallocate = true
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	fileSize := func() int64 {
+		fi, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	if runtime.GOOS == "linux" {
+		require.Equal(t, int64(1024), fileSize())
+	}
+
+	for i := uint64(0); i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		require.Equal(t, width*i, pos)
+	}
+	require.NoError(t, s.buf.Flush())
+	if runtime.GOOS == "linux" {
+		require.Equal(t, int64(1024), fileSize())
+	}
+
+	// a crash leaves the file preallocated, and reopening finds where the records end
+	require.NoError(t, s.File.Close())
+	f, err = os.OpenFile(f.Name(), c.storeOpenFlags(), 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	require.Equal(t, width*3, s.size)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width*3, pos)
+	for i := uint64(0); i < 4; i++ {
+		read, err := s.Read(width * i)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+
+	require.NoError(t, s.Close())
+	require.Equal(t, int64(width*4), fileSize())
+}
+
+func TestStoreFlush(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_flush_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	var syncs int
+	c := Config{}
+	c.Store.Syncer = func(*os.File) error {
+		syncs++
+		return nil
+	}
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	other, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Empty(t, other)
+
+	require.NoError(t, s.Flush())
+	other, err = ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int(width), len(other))
+	require.Equal(t, write, other[lenWidth:])
+	require.Equal(t, 0, syncs)
+	// nothing left to flush
+	require.NoError(t, s.Flush())
+}
+
+func TestStoreWriteAmplification(t *testing.T) {
+	for _, tc := range []struct {
+		version uint8
+		want    float64
+	}{
+		// a length prefix, and a checksum too in v2, for every ten byte payload
+		{FormatV1, 1.8},
+		{FormatV2, 2.2},
+	} {
+		f, err := ioutil.TempFile("", "store_write_amplification_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		c := Config{}
+		c.Store.FormatVersion = tc.version
+		s, err := newStore(f, c)
+		require.NoError(t, err)
+		require.Equal(t, float64(0), s.WriteAmplification())
+		for i := 0; i < 3; i++ {
+			_, _, err = s.Append(make([]byte, 10))
+			require.NoError(t, err)
+		}
+		require.InDelta(t, tc.want, s.WriteAmplification(), 1e-9)
+		require.NoError(t, s.Close())
+	}
+}
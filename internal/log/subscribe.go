@@ -0,0 +1,202 @@
+package log
+
+import (
+	"sync/atomic"
+	"time"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Subscription delivers records appended to the log after it was created. Records are buffered in C; when a subscriber
+falls behind and the buffer is full, new records are dropped for it rather than blocking appends. Every subscription
+gets the same copy of a record, so subscribers mustn't modify the records they receive.
+*/
+type Subscription struct {
+	// dropped is kept first for 64-bit alignment of atomic operations
+	dropped uint64
+	// highWater is the most records that have been buffered at once, only updated while appending
+	highWater int
+
+	C   <-chan *api.Record
+	c   chan *api.Record
+	log *Log
+	id  uint64
+	// stop is closed on unsubscribing to stop the goroutine replaying a SubscribeSince subscription's history into C,
+	// which otherwise is c
+	stop chan struct{}
+}
+
+/*
+SubscriberStat describes how well a subscriber is keeping up with the log.
+*/
+type SubscriberStat struct {
+	ID        uint64
+	Buffered  int
+	Dropped   uint64
+	HighWater int
+}
+
+/*
+Subscribe returns a Subscription that buffers up to buffer records appended from now on. Its channel is closed when
+the subscription or the log is.
+*/
+func (l *Log) Subscribe(buffer int) (*Subscription, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	c := make(chan *api.Record, buffer)
+	l.nextSubID++
+	sub := &Subscription{
+		C:   c,
+		c:   c,
+		log: l,
+		id:  l.nextSubID,
+	}
+	l.subs = append(l.subs, sub)
+	return sub, nil
+}
+
+/*
+SubscribeSince returns a Subscription like Subscribe that first delivers the records still in the log from
+SeekTime(since) on and then carries on with the ones appended from now on, with nothing missed or repeated in between.
+The history is read from the log as the subscriber takes it, so only records appended while it's being replayed count
+against buffer.
+*/
+func (l *Log) SubscribeSince(since time.Time, buffer int) (*Subscription, error) {
+	from, err := l.SeekTime(since)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	local, ok := l.local(from)
+	if !ok {
+		return nil, api.ErrOffsetOutOfRange{Offset: from}
+	}
+	if lowest := l.segments[0].baseOffset; local < lowest {
+		local = lowest
+	}
+	c, out := make(chan *api.Record, buffer), make(chan *api.Record)
+	l.nextSubID++
+	sub := &Subscription{
+		C:    out,
+		c:    c,
+		log:  l,
+		id:   l.nextSubID,
+		stop: make(chan struct{}),
+	}
+	l.subs = append(l.subs, sub)
+	// everything before the next offset is history, the rest is published to c
+	history := &Consumer{l: l, next: local}
+	go sub.replay(history, l.activeSegment.nextOffset, out)
+	return sub, nil
+}
+
+/*
+replay sends the records before the local offset end from history to out, then the ones published to the subscription,
+and closes out once the subscription is closed.
+*/
+func (s *Subscription) replay(history *Consumer, end uint64, out chan<- *api.Record) {
+	defer close(out)
+	for history.next < end {
+		record, err := history.Next()
+		if err == ErrNotReady {
+			break
+		}
+		if err != nil {
+			return
+		}
+		// the rest of the history was deleted and this one was published
+		if history.next > end {
+			break
+		}
+		if !s.forward(record, out) {
+			return
+		}
+	}
+	for record := range s.c {
+		if !s.forward(record, out) {
+			return
+		}
+	}
+}
+
+func (s *Subscription) forward(record *api.Record, out chan<- *api.Record) bool {
+	select {
+	case out <- record:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+/*
+Close stops delivery to the subscription and closes C.
+*/
+func (s *Subscription) Close() {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	s.log.unsubscribe(s)
+}
+
+/*
+SubscriberStats returns the current SubscriberStat of each open subscription.
+*/
+func (l *Log) SubscriberStats() []SubscriberStat {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := make([]SubscriberStat, 0, len(l.subs))
+	for _, sub := range l.subs {
+		stats = append(stats, SubscriberStat{
+			ID:        sub.id,
+			Buffered:  len(sub.c),
+			Dropped:   atomic.LoadUint64(&sub.dropped),
+			HighWater: sub.highWater,
+		})
+	}
+	return stats
+}
+
+/*
+publish hands an appended record to every subscription without blocking. Callers must hold the write lock.
+*/
+func (l *Log) publish(record *api.Record) {
+	if len(l.subs) == 0 {
+		return
+	}
+	// the producer keeps its record, so subscribers share a copy of it
+	record = proto.Clone(record).(*api.Record)
+	for _, sub := range l.subs {
+		select {
+		case sub.c <- record:
+			if n := len(sub.c); n > sub.highWater {
+				sub.highWater = n
+			}
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+/*
+unsubscribe removes the subscription and closes its channel. Callers must hold the write lock.
+*/
+func (l *Log) unsubscribe(s *Subscription) {
+	for i, sub := range l.subs {
+		if sub == s {
+			l.subs = append(l.subs[:i], l.subs[i+1:]...)
+			close(s.c)
+			if s.stop != nil {
+				close(s.stop)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package log
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+)
+
+/*
+Topic manages a log per partition, each in its own subdirectory of the topic's directory named after the partition.
+Offsets are per partition.
+*/
+type Topic struct {
+	Dir        string
+	partitions []*Log
+}
+
+/*
+NewTopic opens or creates a topic with the given number of partitions, every partition's log using c.
+*/
+func NewTopic(dir string, partitions int, c Config) (*Topic, error) {
+	t := &Topic{Dir: dir}
+	if c.InMemory && c.fs == nil {
+		// the partitions share one file system so their directories are all under the topic's
+		c.fs = newMemFS()
+	}
+	for p := 0; p < partitions; p++ {
+		partitionDir := path.Join(dir, strconv.Itoa(p))
+		if err := c.fileSystem().MkdirAll(partitionDir, 0755); err != nil {
+			return nil, err
+		}
+		l, err := NewLog(partitionDir, c)
+		if err != nil {
+			return nil, err
+		}
+		t.partitions = append(t.partitions, l)
+	}
+	return t, nil
+}
+
+func (t *Topic) AppendToPartition(p int, record *api.Record) (uint64, error) {
+	l, err := t.Partition(p)
+	if err != nil {
+		return 0, err
+	}
+	return l.Append(record)
+}
+
+func (t *Topic) ReadFromPartition(p int, off uint64) (*api.Record, error) {
+	l, err := t.Partition(p)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(off)
+}
+
+/*
+Partition returns the log backing partition p.
+*/
+func (t *Topic) Partition(p int) (*Log, error) {
+	if p < 0 || p >= len(t.partitions) {
+		return nil, fmt.Errorf("log: unknown partition %d", p)
+	}
+	return t.partitions[p], nil
+}
+
+func (t *Topic) Partitions() int {
+	return len(t.partitions)
+}
+
+func (t *Topic) Close() error {
+	for _, l := range t.partitions {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
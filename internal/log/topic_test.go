@@ -0,0 +1,48 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topic, err := NewTopic(dir, 2, Config{})
+	require.NoError(t, err)
+	require.Equal(t, 2, topic.Partitions())
+
+	for i := 0; i < 3; i++ {
+		off, err := topic.AppendToPartition(0, &api.Record{Value: []byte(fmt.Sprintf("zero-%d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	off, err := topic.AppendToPartition(1, &api.Record{Value: []byte("one-0")})
+	require.NoError(t, err)
+	// offsets are per partition
+	require.Equal(t, uint64(0), off)
+	_, err = topic.AppendToPartition(2, &api.Record{Value: []byte("nope")})
+	require.Error(t, err)
+	require.NoError(t, topic.Close())
+
+	topic, err = NewTopic(dir, 2, Config{})
+	require.NoError(t, err)
+	defer topic.Close()
+	for i := 0; i < 3; i++ {
+		record, err := topic.ReadFromPartition(0, uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("zero-%d", i), string(record.Value))
+	}
+	record, err := topic.ReadFromPartition(1, 0)
+	require.NoError(t, err)
+	require.Equal(t, "one-0", string(record.Value))
+	_, err = topic.ReadFromPartition(1, 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentWarmup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-warmup-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Warmup())
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Warmup())
+	record, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestLogWarmup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-warmup-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := newTestLog(dir, rollConfig(t, 2))
+	require.NoError(t, err)
+	defer l.Close()
+	appendRolls(t, l, 3)
+
+	require.NoError(t, l.Warmup(rollOffset))
+	require.NoError(t, l.Warmup(rollOffset+2))
+	require.Error(t, l.Warmup(rollOffset+3))
+}
+
+/*
+BenchmarkSegmentWarmup times reading every record of a freshly opened segment, with and without warming it up first.
+The files were just written so they're likely cached either way unless the cache is dropped between runs.
+*/
+func BenchmarkSegmentWarmup(b *testing.B) {
+	dir, err := ioutil.TempDir("", "segment-warmup-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	const records = 1000
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 30
+	c.Segment.MaxIndexBytes = entWidth * records
+	s, err := newSegment(dir, 0, c)
+	require.NoError(b, err)
+	for i := 0; i < records; i++ {
+		_, err = s.Append(&api.Record{Value: make([]byte, 1024)})
+		require.NoError(b, err)
+	}
+	require.NoError(b, s.Close())
+
+	for _, warm := range []bool{false, true} {
+		name := "cold"
+		if warm {
+			name = "warm"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s, err := newSegment(dir, 0, c)
+				require.NoError(b, err)
+				if warm {
+					require.NoError(b, s.Warmup())
+				}
+				b.StartTimer()
+				for off := uint64(0); off < records; off++ {
+					if _, err = s.Read(off); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				require.NoError(b, s.Close())
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package log
+
+import (
+	"errors"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// number of bytes used by a wire batch's header: the record count and the length of the entries after it
+	wireHeaderWidth = 4 + 8
+	// number of bytes in front of each entry's record: its offset and length
+	wireEntryWidth = 8 + 4
+)
+
+var ErrBadWireBatch = errors.New("log: malformed wire batch")
+
+/*
+WireEncodeBatch frames records for sending over the network in one go, so clients and servers built on the log share a
+format. A batch is a header with the record count and the byte length of what follows, then every record's offset,
+length and marshaled bytes, all big endian like the store.
+*/
+func WireEncodeBatch(records []*api.Record) ([]byte, error) {
+	p := make([]byte, wireHeaderWidth)
+	for _, record := range records {
+		b, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		entry := make([]byte, wireEntryWidth)
+		enc.PutUint64(entry, record.Offset)
+		enc.PutUint32(entry[8:], uint32(len(b)))
+		p = append(append(p, entry...), b...)
+	}
+	enc.PutUint32(p, uint32(len(records)))
+	enc.PutUint64(p[4:], uint64(len(p)-wireHeaderWidth))
+	return p, nil
+}
+
+/*
+WireDecodeBatch decodes a batch made by WireEncodeBatch, failing with ErrBadWireBatch if it's truncated or its header
+doesn't match its entries.
+*/
+func WireDecodeBatch(p []byte) ([]*api.Record, error) {
+	if len(p) < wireHeaderWidth {
+		return nil, ErrBadWireBatch
+	}
+	n, length := enc.Uint32(p), enc.Uint64(p[4:])
+	p = p[wireHeaderWidth:]
+	if uint64(len(p)) != length {
+		return nil, ErrBadWireBatch
+	}
+	// the count comes off the wire, so check the entries could fit before allocating for them
+	if uint64(n) > length/wireEntryWidth {
+		return nil, ErrBadWireBatch
+	}
+	records := make([]*api.Record, 0, n)
+	for i := uint32(0); i < n; i++ {
+		if len(p) < wireEntryWidth {
+			return nil, ErrBadWireBatch
+		}
+		off, size := enc.Uint64(p), uint64(enc.Uint32(p[8:]))
+		p = p[wireEntryWidth:]
+		if uint64(len(p)) < size {
+			return nil, ErrBadWireBatch
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p[:size], record); err != nil {
+			return nil, err
+		}
+		record.Offset = off
+		records = append(records, record)
+		p = p[size:]
+	}
+	if len(p) > 0 {
+		return nil, ErrBadWireBatch
+	}
+	return records, nil
+}
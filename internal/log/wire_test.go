@@ -0,0 +1,44 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWireBatch(t *testing.T) {
+	records := []*api.Record{
+		{Value: []byte("hello world"), Offset: 16},
+		{Offset: 17},
+		{Value: []byte("with headers"), Offset: 18, Headers: map[string][]byte{"key": []byte("value")}},
+		{},
+	}
+	p, err := WireEncodeBatch(records)
+	require.NoError(t, err)
+	got, err := WireDecodeBatch(p)
+	require.NoError(t, err)
+	require.Len(t, got, len(records))
+	for i := range records {
+		require.True(t, proto.Equal(records[i], got[i]), "record %d", i)
+	}
+
+	empty, err := WireEncodeBatch(nil)
+	require.NoError(t, err)
+	got, err = WireDecodeBatch(empty)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	// truncated batches and ones with trailing bytes are refused
+	for _, bad := range [][]byte{p[:len(p)-1], append(append([]byte{}, p...), 0), p[:wireHeaderWidth-1]} {
+		_, err = WireDecodeBatch(bad)
+		require.Equal(t, ErrBadWireBatch, err)
+	}
+
+	// a count more entries than the batch could hold is refused without allocating for them
+	impossible := make([]byte, wireHeaderWidth)
+	enc.PutUint32(impossible, 0xFFFFFFFF)
+	_, err = WireDecodeBatch(impossible)
+	require.Equal(t, ErrBadWireBatch, err)
+}
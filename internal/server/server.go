@@ -3,11 +3,14 @@ package server
 import (
 	"context"
 	api "github.com/dfcarpenter/proglog/api/v1"
+	"github.com/dfcarpenter/proglog/internal/log"
 	"google.golang.org/grpc"
 )
 
 type Config struct {
 	CommitLog CommitLog
+	// Acks tracks what ConsumeAcked streams' consumers have acked, kept in memory if nil
+	Acks *log.AckTracker
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -18,6 +21,9 @@ type grpcServer struct {
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.Acks == nil {
+		config.Acks = log.NewAckTracker(nil)
+	}
 	srv = &grpcServer{
 		Config: config,
 	}
@@ -47,6 +53,13 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
+	if req.Raw {
+		p, codec, err := s.CommitLog.ReadRaw(req.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ConsumeResponse{Raw: p, Codec: uint32(codec), Offset: req.Offset}, nil
+	}
 	record, err := s.CommitLog.Read(req.Offset)
 	if err != nil {
 		return nil, err
@@ -99,8 +112,33 @@ func (s *grpcServer) ConsumeStream(
 	}
 }
 
+/*
+ConsumeAcked streams records to the consumer named by the stream's first message from the first record it didn't ack
+on its previous stream, taking acks for what's sent from the rest, so records sent before a disconnect but never acked
+are sent again.
+*/
+func (s *grpcServer) ConsumeAcked(stream api.Log_ConsumeAckedServer) error {
+	return s.Acks.Serve(stream, s.Consume)
+}
+
+
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (
+	*api.ConsumeBatchResponse, error) {
+	token := req.Token
+	if len(token) == 0 {
+		token = log.Token(req.Offset)
+	}
+	records, next, err := s.CommitLog.ConsumeBatch(token, int(req.MaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeBatchResponse{Records: records, Token: next}, nil
+}
+
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	ReadRaw(uint64) ([]byte, uint8, error)
+	ConsumeBatch(token []byte, maxBytes int) ([]*api.Record, []byte, error)
 }